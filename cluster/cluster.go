@@ -0,0 +1,296 @@
+// Package cluster is the registry of mongo clusters that collections are exported from,
+// along with the export config for each one.
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+	"gopkg.in/yaml.v2"
+)
+
+var log = logger.New("mongo-to-s3")
+
+// Env vars the registry is read from. DocumentEnvVar holds a YAML (or JSON) document
+// mapping cluster names to clusters. Clusters can also be given one setting per env var,
+// e.g. MONGO_TO_S3_CLUSTERS_SIS_URL.
+const (
+	DocumentEnvVar = "MONGO_TO_S3_CLUSTERS"
+	envVarPrefix   = DocumentEnvVar + "_"
+)
+
+// Cluster is a mongo cluster and the export config for its collections
+type Cluster struct {
+	Name string `yaml:"-"`
+	// Source is where the cluster was found, e.g. MONGO_TO_S3_CLUSTERS
+	Source string `yaml:"-"`
+	// URL is the mongo connection string
+	URL string `yaml:"url"`
+	// Username and Password are used to log in if set
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// PasswordEnv is an env var to read the password from instead, so the registry
+	// itself doesn't have to hold secrets
+	PasswordEnv string `yaml:"password_env"`
+	// UsernameFile and PasswordFile are files to read the credentials from, e.g. mounted
+	// secrets. They're read every time the cluster is dialed.
+	UsernameFile string `yaml:"username_file"`
+	PasswordFile string `yaml:"password_file"`
+	// CredentialsCommand is run every time the cluster is dialed, and prints the password
+	// or a JSON object with the username and password
+	CredentialsCommand []string `yaml:"credentials_command"`
+	// TLS is how connections to the cluster are secured
+	TLS TLSConfig `yaml:"tls"`
+	// Config is the YAML export config for the cluster's collections
+	Config string `yaml:"config"`
+}
+
+// Registry looks up clusters by name. Clusters are only read from the environment when
+// they're looked up, so a missing setting for one cluster doesn't affect the others.
+type Registry struct {
+	env       map[string]string
+	documents map[string]Cluster
+}
+
+// FromEnv returns a registry reading from the given environment, in os.Environ's format
+func FromEnv(environ []string) (*Registry, error) {
+	r := &Registry{env: map[string]string{}, documents: map[string]Cluster{}}
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 {
+			r.env[kv[:i]] = kv[i+1:]
+		}
+	}
+	if doc := r.env[DocumentEnvVar]; doc != "" {
+		if err := yaml.Unmarshal([]byte(doc), &r.documents); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", DocumentEnvVar, err)
+		}
+	}
+	return r, nil
+}
+
+// envName is the form of a cluster's name used in env vars, e.g. SIS_READ for sis_read
+func envName(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Lookup finds a cluster, looking in order at
+//
+//   - the MONGO_TO_S3_CLUSTERS document
+//   - MONGO_TO_S3_CLUSTERS_<NAME>_URL, _USERNAME, _PASSWORD, _USERNAME_FILE, _PASSWORD_FILE,
+//     _CREDENTIALS_COMMAND (split on spaces), _TLS_CA_FILE, _TLS_CERT_FILE, _TLS_KEY_FILE,
+//     _TLS_SERVER_NAME, _TLS_X509 and _CONFIG
+//   - <NAME>_URL, _USERNAME, _PASSWORD and _CONFIG, which is how clusters used to be configured
+//
+// The cluster's settings aren't checked beyond its credentials and TLS, since not
+// everything needs all of them.
+func (r *Registry) Lookup(name string) (Cluster, error) {
+	if name == "" {
+		return Cluster{}, fmt.Errorf("no cluster specified")
+	}
+	c, ok := r.documents[name]
+	c.Source = DocumentEnvVar
+	if !ok {
+		for _, prefix := range []string{envVarPrefix, ""} {
+			prefix += envName(name) + "_"
+			c = Cluster{
+				Source:             prefix + "*",
+				URL:                r.env[prefix+"URL"],
+				Username:           r.env[prefix+"USERNAME"],
+				Password:           r.env[prefix+"PASSWORD"],
+				UsernameFile:       r.env[prefix+"USERNAME_FILE"],
+				PasswordFile:       r.env[prefix+"PASSWORD_FILE"],
+				CredentialsCommand: commandFromEnv(r.env[prefix+"CREDENTIALS_COMMAND"]),
+				TLS: TLSConfig{
+					CAFile:     r.env[prefix+"TLS_CA_FILE"],
+					CertFile:   r.env[prefix+"TLS_CERT_FILE"],
+					KeyFile:    r.env[prefix+"TLS_KEY_FILE"],
+					ServerName: r.env[prefix+"TLS_SERVER_NAME"],
+					X509:       r.env[prefix+"TLS_X509"] == "true",
+				},
+				Config: r.env[prefix+"CONFIG"],
+			}
+			if c.URL != "" || c.Config != "" {
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		return Cluster{}, fmt.Errorf("unknown cluster '%s', known clusters are: %s", name, strings.Join(r.Names(), ", "))
+	}
+
+	c.Name = name
+	if c.PasswordEnv != "" {
+		if c.Password = r.env[c.PasswordEnv]; c.Password == "" {
+			return Cluster{}, fmt.Errorf("cluster '%s' password env var %s isn't set", name, c.PasswordEnv)
+		}
+	}
+	if err := c.check(); err != nil {
+		return Cluster{}, err
+	}
+	return c, nil
+}
+
+// Names lists the clusters in the MONGO_TO_S3_CLUSTERS document and env vars. Clusters
+// only configured the old way aren't included.
+func (r *Registry) Names() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for name := range r.documents {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for key := range r.env {
+		if !strings.HasPrefix(key, envVarPrefix) {
+			continue
+		}
+		for _, suffix := range []string{"_URL", "_CONFIG"} {
+			if strings.HasSuffix(key, suffix) {
+				name := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(key, envVarPrefix), suffix))
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// check catches credential and TLS settings that can't work together
+func (c Cluster) check() error {
+	if err := c.TLS.check(c.Name); err != nil {
+		return err
+	}
+	if _, err := c.CredentialProvider(); err != nil {
+		return err
+	}
+	if c.TLS.X509 && (c.Username != "" || c.Password != "" || c.PasswordEnv != "" || c.UsernameFile != "" ||
+		c.PasswordFile != "" || len(c.CredentialsCommand) > 0) {
+		return fmt.Errorf("cluster '%s' uses x509, so it can't have a username or password", c.Name)
+	}
+	return nil
+}
+
+// authenticationFailed is the error code servers return for bad credentials
+const authenticationFailed = 18
+
+// connectClient connects and makes sure the servers can be reached. Tests swap it out.
+var connectClient = func(ctx context.Context, opts *options.ClientOptions) (*mongo.Client, error) {
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	// connecting doesn't wait for the servers, so make sure they can be reached
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// Dial connects to the cluster, reading from secondaries, and returns the database named
+// in its url. Connections use TLS if the url asks for it or the cluster has TLS settings. The credentials and certificates are read on every call. If
+// the servers reject the credentials, e.g. because they were rotated since they were
+// fetched, the credentials are fetched again and the cluster is dialed once more.
+func (c Cluster) Dial(ctx context.Context) (*mongo.Database, error) {
+	log.InfoD("mongo-connection-call", logger.M{"cluster": c.Name, "url": c.Hosts()})
+	if c.URL == "" {
+		return nil, fmt.Errorf("cluster '%s' has no url", c.Name)
+	}
+	cs, err := connstring.Parse(c.URL)
+	if err != nil {
+		log.ErrorD("mongo-parse-url-error", logger.M{"error": err.Error()})
+		return nil, err
+	}
+
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	var subject string
+	if c.TLS.set() {
+		if tlsConfig, subject, err = c.TLS.config(); err != nil {
+			log.ErrorD("mongo-tls-error", logger.M{"cluster": c.Name, "error": err.Error()})
+			return nil, err
+		}
+	}
+
+	client, err := c.connect(ctx, tlsConfig, subject)
+	if err != nil && isAuthError(err) && !c.TLS.X509 {
+		log.WarnD("mongo-auth-retry", logger.M{"cluster": c.Name, "error": err.Error()})
+		client, err = c.connect(ctx, tlsConfig, subject)
+	}
+	if err != nil {
+		log.ErrorD("mongo-dial-error", logger.M{"error": err.Error()})
+		return nil, err
+	}
+	log.Info("mongo-dial-successful")
+
+	database := cs.Database
+	if database == "" {
+		// mgo's default, so a url without a database reads from where it always has
+		database = "test"
+	}
+	return client.Database(database), nil
+}
+
+// connect fetches the cluster's credentials and connects with them. A nil tlsConfig leaves
+// TLS up to the url.
+func (c Cluster) connect(ctx context.Context, tlsConfig *tls.Config, subject string) (*mongo.Client, error) {
+	opts := options.Client().ApplyURI(c.URL).SetReadPreference(readpref.Secondary())
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// start from the url's credentials so its authSource and authMechanism still apply
+	auth := options.Credential{}
+	if opts.Auth != nil {
+		auth = *opts.Auth
+	}
+	if c.TLS.X509 {
+		log.InfoD("mongo-x509-auth", logger.M{"subject": subject})
+		opts.SetAuth(options.Credential{AuthMechanism: "MONGODB-X509", AuthSource: "$external", Username: subject})
+	} else if creds, err := c.credentials(); err != nil {
+		log.ErrorD("mongo-credentials-error", logger.M{"cluster": c.Name, "error": err.Error()})
+		return nil, err
+	} else if creds.Username != "" {
+		log.Info("mongo-username-set")
+		auth.Username = creds.Username
+		if creds.Password != "" {
+			log.Info("mongo-password-set")
+			auth.Password = creds.Password
+		}
+		opts.SetAuth(auth)
+	}
+	return connectClient(ctx, opts)
+}
+
+// isAuthError checks whether the servers rejected the credentials
+func isAuthError(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == authenticationFailed {
+		return true
+	}
+	// the driver reports failed handshakes as connection errors rather than command errors
+	return strings.Contains(err.Error(), "auth error")
+}
+
+// Hosts returns the hosts in the cluster's url, leaving out the credentials
+func (c Cluster) Hosts() string {
+	cs, err := connstring.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.Join(cs.Hosts, ",")
+}
@@ -0,0 +1,142 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandTimeout is how long a credentials command gets to print the credentials
+const commandTimeout = 30 * time.Second
+
+// Credentials are what a cluster is logged in to with
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CredentialProvider fetches a cluster's credentials. It's asked every time the cluster is
+// dialed, and again if the servers reject what it returned, so rotated secrets are picked
+// up without a redeploy.
+type CredentialProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// staticCredentials are credentials set in the registry or env vars
+type staticCredentials Credentials
+
+func (s staticCredentials) Credentials() (Credentials, error) {
+	return Credentials(s), nil
+}
+
+// fileCredentials reads credentials from files, e.g. secrets mounted into the container.
+// The username is only read from a file if there's no fixed username.
+type fileCredentials struct {
+	username     string
+	usernameFile string
+	passwordFile string
+}
+
+func (f fileCredentials) Credentials() (Credentials, error) {
+	creds := Credentials{Username: f.username}
+	for _, file := range []struct {
+		path string
+		dest *string
+	}{{f.usernameFile, &creds.Username}, {f.passwordFile, &creds.Password}} {
+		if file.path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("failed to read credentials: %s", err)
+		}
+		*file.dest = strings.TrimSpace(string(data))
+	}
+	return creds, nil
+}
+
+// commandCredentials runs a command, e.g. a secret manager's client, that prints either
+// the password or a JSON object with the username and password
+type commandCredentials struct {
+	username string
+	command  []string
+}
+
+func (c commandCredentials) Credentials() (Credentials, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("credentials command %s failed: %s: %s", c.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	out = bytes.TrimSpace(out)
+	creds := Credentials{Username: c.username}
+	if !bytes.HasPrefix(out, []byte("{")) {
+		creds.Password = string(out)
+		return creds, nil
+	}
+	var printed Credentials
+	if err := json.Unmarshal(out, &printed); err != nil {
+		return Credentials{}, fmt.Errorf("credentials command %s printed invalid JSON: %s", c.command[0], err)
+	}
+	creds.Password = printed.Password
+	if printed.Username != "" {
+		creds.Username = printed.Username
+	}
+	return creds, nil
+}
+
+// CredentialProvider returns where the cluster's credentials come from: a command, files,
+// or the username and password set in the registry or env vars. Only one may be configured.
+func (c Cluster) CredentialProvider() (CredentialProvider, error) {
+	sources := []string{}
+	if len(c.CredentialsCommand) > 0 {
+		sources = append(sources, "credentials_command")
+	}
+	if c.UsernameFile != "" || c.PasswordFile != "" {
+		sources = append(sources, "username_file/password_file")
+	}
+	if c.Password != "" || c.PasswordEnv != "" {
+		sources = append(sources, "password/password_env")
+	}
+	if len(sources) > 1 {
+		return nil, fmt.Errorf("cluster '%s' has more than one source of credentials: %s", c.Name, strings.Join(sources, ", "))
+	}
+	if c.Username != "" && c.UsernameFile != "" {
+		return nil, fmt.Errorf("cluster '%s' has both a username and a username_file", c.Name)
+	}
+
+	switch {
+	case len(c.CredentialsCommand) > 0:
+		return commandCredentials{username: c.Username, command: c.CredentialsCommand}, nil
+	case c.UsernameFile != "" || c.PasswordFile != "":
+		return fileCredentials{username: c.Username, usernameFile: c.UsernameFile, passwordFile: c.PasswordFile}, nil
+	}
+	return staticCredentials{Username: c.Username, Password: c.Password}, nil
+}
+
+// credentials fetches the cluster's credentials from its provider
+func (c Cluster) credentials() (Credentials, error) {
+	provider, err := c.CredentialProvider()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return provider.Credentials()
+}
+
+// commandFromEnv splits a credentials command set in an env var on spaces
+func commandFromEnv(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Fields(value)
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig is how a cluster's TLS connections are set up. The zero value trusts the
+// system's roots and presents no client certificate.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the CAs to trust instead of the system's roots
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the PEM client certificate and key. KeyFile defaults to
+	// CertFile, since mongo usually has both in one file.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerName overrides the name the servers' certificates are checked against
+	ServerName string `yaml:"server_name"`
+	// X509 logs in with MONGODB-X509 as the client certificate's subject instead of a password
+	X509 bool `yaml:"x509"`
+}
+
+// set is whether any settings are given, which turns TLS on whatever the url says
+func (t TLSConfig) set() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != "" || t.X509
+}
+
+// check catches settings that can't work together, without reading any files
+func (t TLSConfig) check(name string) error {
+	if t.KeyFile != "" && t.CertFile == "" {
+		return fmt.Errorf("cluster '%s' has a tls key_file but no cert_file", name)
+	}
+	if t.X509 && t.CertFile == "" {
+		return fmt.Errorf("cluster '%s' uses x509 but has no tls cert_file", name)
+	}
+	return nil
+}
+
+// config builds the tls.Config to dial with. It also returns the client certificate's
+// subject, which is the username for MONGODB-X509, or "" if there's no certificate.
+func (t TLSConfig) config() (*tls.Config, string, error) {
+	conf := &tls.Config{ServerName: t.ServerName}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read tls ca_file: %s", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, "", fmt.Errorf("no certificates found in tls ca_file %s", t.CAFile)
+		}
+	}
+	if t.CertFile == "" {
+		return conf, "", nil
+	}
+
+	keyFile := t.KeyFile
+	if keyFile == "" {
+		keyFile = t.CertFile
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, keyFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load tls client certificate: %s", err)
+	}
+	conf.Certificates = []tls.Certificate{cert}
+	subject, err := certificateSubject(cert)
+	if err != nil {
+		return nil, "", err
+	}
+	return conf, subject, nil
+}
+
+// certificateSubject is a certificate's subject in RFC 2253 form, which is what mongo
+// expects as the MONGODB-X509 username. It's read from the raw subject to keep the
+// order of its attributes.
+func certificateSubject(cert tls.Certificate) (string, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to parse tls client certificate: %s", err)
+	}
+	var subject pkix.RDNSequence
+	if _, err := asn1.Unmarshal(leaf.RawSubject, &subject); err != nil {
+		return "", fmt.Errorf("failed to parse tls client certificate subject: %s", err)
+	}
+	return subject.String(), nil
+}
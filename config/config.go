@@ -1,6 +1,9 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+
 	json "github.com/pquerna/ffjson/ffjson"
 
 	"gopkg.in/Clever/optimus.v3"
@@ -10,6 +13,12 @@ import (
 
 type Config map[string]Table
 
+// Output formats for the exported data files
+const (
+	FormatJSON    = "json"
+	FormatParquet = "parquet"
+)
+
 type Table struct {
 	Destination string  `yaml:"dest"`
 	Source      string  `yaml:"source"`
@@ -21,6 +30,14 @@ type Field struct {
 	Destination string `yaml:"dest"`
 	Source      string `yaml:"source"`
 	PII         bool   `yaml:"pii"`
+	Type        string `yaml:"type"`
+	PrimaryKey  bool   `yaml:"primarykey"`
+	NotNull     bool   `yaml:"notnull"`
+	SortOrd     int    `yaml:"sortord"`
+	DistKey     bool   `yaml:"distkey"`
+	// LengthPolicy is what to do with text values over the column's length limit:
+	// truncate (the default), null or fail
+	LengthPolicy string `yaml:"length_policy"`
 }
 
 type Meta struct {
@@ -32,6 +49,41 @@ type Meta struct {
 	// if there are other fields in it. This breaks things like oauthclients and launchpads,
 	// so we can't turn it on for everything
 	UseProjectionOptimization bool `yaml:"projection_optimization"`
+	// IncrementalField turns on incremental exports. Each run only pulls documents whose
+	// value for this field is greater than the high-water mark saved by the previous
+	// successful run. The field should be indexed and monotonically increasing on write,
+	// e.g. _id or updatedAt.
+	IncrementalField string `yaml:"incremental_field"`
+	// Format is the output format of the data files, either json (the default) or parquet
+	Format string `yaml:"format"`
+	// DetectDrift writes a report of fields in the collection that aren't in the columns,
+	// and columns that never show up in the collection, alongside each export
+	DetectDrift bool `yaml:"detect_drift"`
+	// Encryption is how the uploaded files are encrypted. Defaults to sse-s3.
+	Encryption Encryption `yaml:"encryption"`
+}
+
+// Encryption modes
+const (
+	// EncryptionSSES3 has s3 encrypt objects with its own keys
+	EncryptionSSES3 = "sse-s3"
+	// EncryptionSSEKMS has s3 encrypt objects with a KMS key
+	EncryptionSSEKMS = "sse-kms"
+	// EncryptionClient encrypts the data files before they're uploaded, in the envelope
+	// Redshift loads with COPY's ENCRYPTED option
+	EncryptionClient = "client"
+	// EncryptionNone uploads objects unencrypted, e.g. for stores that don't support sse
+	EncryptionNone = "none"
+)
+
+// Encryption configures how uploaded objects are encrypted
+type Encryption struct {
+	Mode string `yaml:"mode"`
+	// KMSKeyID is the KMS key for sse-kms. Empty uses the account's default s3 key.
+	KMSKeyID   string            `yaml:"kms_key_id"`
+	KMSContext map[string]string `yaml:"kms_context"`
+	// KeyFile holds the 32 byte key for client encryption, either raw or base64 encoded
+	KeyFile string `yaml:"key_file"`
 }
 
 // ParseYAML marshalls data into a Config
@@ -55,6 +107,46 @@ func (t Table) FieldMap() map[string][]string {
 	return mappings
 }
 
+// Destinations returns the destination column names in the order they're configured,
+// skipping duplicates
+func (t Table) Destinations() []string {
+	seen := map[string]bool{}
+	columns := []string{}
+	for _, field := range t.Fields {
+		if field.Destination != "" && !seen[field.Destination] {
+			seen[field.Destination] = true
+			columns = append(columns, field.Destination)
+		}
+	}
+	return columns
+}
+
+// JSONPaths is a Redshift JSONPaths file, which tells COPY which JSON key goes in each column
+type JSONPaths struct {
+	Paths []string `json:"jsonpaths"`
+}
+
+// JSONPaths returns the JSONPaths file for loading the table's JSON data files. There's a
+// path for each destination column in order, followed by the data date column if it isn't
+// one of them. Missing keys are loaded as nulls.
+func (t Table) JSONPaths() JSONPaths {
+	columns := t.Destinations()
+	found := false
+	for _, column := range columns {
+		found = found || column == t.Meta.DataDateColumn
+	}
+	if !found && t.Meta.DataDateColumn != "" {
+		columns = append(columns, t.Meta.DataDateColumn)
+	}
+
+	paths := JSONPaths{Paths: []string{}}
+	for _, column := range columns {
+		// bracket notation since column names can have dots in them
+		paths.Paths = append(paths.Paths, fmt.Sprintf("$['%s']", strings.Replace(column, "'", `\'`, -1)))
+	}
+	return paths
+}
+
 // GetPopulateDateFn returns a function which creates and populates the data date column
 // we do this so that we have a good idea of when the data was created downstream
 func GetPopulateDateFn(dataDateColumn, timestamp string) func(optimus.Row) (optimus.Row, error) {
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"gopkg.in/Clever/optimus.v3"
 	"gopkg.in/Clever/optimus.v3/sources/slice"
 	"gopkg.in/Clever/optimus.v3/tests"
@@ -53,18 +56,22 @@ func TestValidYAML(t *testing.T) {
 		{
 			Destination: "id",
 			Source:      "_id",
+			Type:        "text",
 		}, {
 			Destination: "district_id",
 			Source:      "district",
+			Type:        "text",
 		}, {
 			Destination: "type",
 			Source:      "data.type",
+			Type:        "text",
 		},
 	}
 
 	for idx, field := range table.Fields {
 		assert.Equal(t, fields[idx].Destination, field.Destination)
 		assert.Equal(t, fields[idx].Source, field.Source)
+		assert.Equal(t, fields[idx].Type, field.Type)
 	}
 }
 
@@ -175,3 +182,290 @@ func TestFlatten(t *testing.T) {
 		assert.Equal(t, expected[i], valueRet)
 	}
 }
+
+func TestDestinations(t *testing.T) {
+	table := Table{
+		Fields: []Field{
+			{Destination: "_data_timestamp"},
+			{Destination: "id", Source: "_id"},
+			{Destination: "name", Source: "name"},
+			{Destination: "id", Source: "other_id"},
+			{Source: "ignored"},
+		},
+	}
+	assert.Equal(t, []string{"_data_timestamp", "id", "name"}, table.Destinations())
+}
+
+func TestJSONPaths(t *testing.T) {
+	table := Table{
+		Fields: []Field{
+			{Destination: "id", Source: "_id"},
+			{Destination: "location.city", Source: "location.city"},
+			{Destination: "id", Source: "other_id"},
+		},
+		Meta: Meta{DataDateColumn: "_data_timestamp"},
+	}
+	assert.Equal(t, []string{"$['id']", "$['location.city']", "$['_data_timestamp']"}, table.JSONPaths().Paths)
+
+	table.Fields = append([]Field{{Destination: "_data_timestamp"}}, table.Fields...)
+	assert.Equal(t, []string{"$['_data_timestamp']", "$['id']", "$['location.city']"}, table.JSONPaths().Paths)
+}
+
+func TestCoerceValue(t *testing.T) {
+	now := time.Date(2016, 1, 27, 21, 0, 0, 500000000, time.UTC)
+	id, err := primitive.ObjectIDFromHex("56a931ea2b1c8d2b0d8b4567")
+	assert.NoError(t, err)
+	valid := []struct {
+		columnType string
+		input      interface{}
+		expected   interface{}
+	}{
+		{TypeText, id, "56a931ea2b1c8d2b0d8b4567"},
+		{TypeText, now, "2016-01-27T21:00:00.5Z"},
+		{TypeText, 12, "12"},
+		{TypeText, true, "true"},
+		{TypeLongText, "foo", "foo"},
+		{TypeTimestamp, now, "2016-01-27T21:00:00.5Z"},
+		{TypeTimestamp, "2016-01-27T13:00:00-08:00", "2016-01-27T21:00:00Z"},
+		{TypeInt, "42", int64(42)},
+		{TypeInt, 42.0, int64(42)},
+		{TypeBigInt, int64(1) << 40, int64(1) << 40},
+		{TypeFloat, "1.5", 1.5},
+		{TypeFloat, 3, 3.0},
+		{TypeBoolean, "true", true},
+		{TypeBoolean, 0, false},
+		{TypeBoolean, false, false},
+		{"", id, id},
+		{TypeInt, nil, nil},
+	}
+	for _, test := range valid {
+		val, err := CoerceValue(test.columnType, test.input)
+		assert.NoError(t, err, "%s %v", test.columnType, test.input)
+		assert.Equal(t, test.expected, val, "%s %v", test.columnType, test.input)
+	}
+
+	invalid := []struct {
+		columnType string
+		input      interface{}
+	}{
+		{TypeTimestamp, "yesterday"},
+		{TypeTimestamp, 12},
+		{TypeInt, "12abc"},
+		{TypeInt, 1.5},
+		{TypeInt, int64(1) << 40},
+		{TypeFloat, now},
+		{TypeBoolean, "maybe"},
+		{TypeBoolean, 2},
+		{"uuid", "foo"},
+	}
+	for _, test := range invalid {
+		_, err := CoerceValue(test.columnType, test.input)
+		assert.Error(t, err, "%s %v", test.columnType, test.input)
+	}
+}
+
+func TestTypeCoercionFn(t *testing.T) {
+	table := Table{
+		Fields: []Field{
+			{Destination: "count", Source: "count", Type: TypeInt},
+			{Destination: "name", Source: "name", Type: TypeText},
+		},
+	}
+	failures := map[string]int{}
+	coerce := GetTypeCoercionFn(table, func(column string, err error) {
+		failures[column]++
+	})
+
+	row, err := coerce(optimus.Row{"count": "12", "name": 5})
+	assert.NoError(t, err)
+	assert.Equal(t, optimus.Row{"count": int64(12), "name": "5"}, row)
+
+	row, err = coerce(optimus.Row{"count": "lots", "name": "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, optimus.Row{"count": nil, "name": "foo"}, row)
+	assert.Equal(t, map[string]int{"count": 1}, failures)
+}
+
+func TestLengthLimitFn(t *testing.T) {
+	table := Table{
+		Fields: []Field{
+			{Destination: "short", Source: "short", Type: TypeText, LengthPolicy: LengthPolicyTruncate},
+			{Destination: "nulled", Source: "nulled", Type: TypeText, LengthPolicy: LengthPolicyNull},
+			{Destination: "long", Source: "long", Type: TypeLongText, LengthPolicy: LengthPolicyFail},
+			{Destination: "default", Source: "default", Type: TypeText},
+			{Destination: "count", Source: "count", Type: TypeInt},
+		},
+	}
+	violations := map[string]int{}
+	limit := GetLengthLimitFn(table, func(column string) {
+		violations[column]++
+	})
+
+	tooLong := strings.Repeat("a", TextMaxLength+1)
+	row, err := limit(optimus.Row{"short": tooLong, "nulled": tooLong, "long": tooLong, "default": tooLong, "count": int64(1)})
+	assert.NoError(t, err)
+	// values are truncated unless the column says otherwise
+	assert.Equal(t, optimus.Row{
+		"short": strings.Repeat("a", TextMaxLength), "nulled": nil, "long": tooLong, "default": strings.Repeat("a", TextMaxLength), "count": int64(1),
+	}, row)
+	assert.Equal(t, map[string]int{"short": 1, "nulled": 1, "default": 1}, violations)
+
+	_, err = limit(optimus.Row{"long": strings.Repeat("a", LongTextMaxLength+1)})
+	assert.EqualError(t, err, "value for column 'long' is 65536 bytes, over the limit of 65535")
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "abc", truncate("abcdef", 3))
+	// don't split the two byte é
+	assert.Equal(t, "ab", truncate("abé", 3))
+}
+
+func TestValidate(t *testing.T) {
+	conf, err := ParseYAML([]byte(`
+good:
+  dest: good_dest
+  source: good_source
+  columns:
+  - dest: _data_timestamp
+    type: timestamp
+    sortord: 1
+  - dest: id
+    source: _id
+    type: text
+    primarykey: true
+    notnull: true
+  - dest: email
+    source: email
+    pii: true
+  meta:
+    datadatecolumn: _data_timestamp
+    encryption:
+      mode: sse-kms
+      kms_key_id: alias/student-data
+      kms_context:
+        table: good_dest
+bad:
+  source: bad_source
+  columns:
+  - dest: id
+    source: _id
+    type: text
+    primarykey: true
+    sortord: 2
+  - dest: id
+    source: other
+    type: uuid
+  - dest: email
+    source: email
+    type: text
+    pii: true
+    length_policy: chop
+  meta:
+    format: csv
+    encryption:
+      mode: client
+      kms_key_id: alias/student-data
+parquet:
+  dest: parquet_dest
+  source: parquet_source
+  columns:
+  - dest: _data_timestamp
+    type: timestamp
+  meta:
+    datadatecolumn: _data_timestamp
+    format: parquet
+    encryption:
+      mode: client
+      key_file: /keys/parquet
+`))
+	assert.NoError(t, err)
+
+	var messages []string
+	for _, verr := range conf.Validate() {
+		messages = append(messages, verr.Error())
+	}
+	assert.Equal(t, []string{
+		"bad: missing dest",
+		"bad: unknown format 'csv'",
+		"bad: encryption kms_key_id and kms_context only apply to mode sse-kms",
+		"bad: encryption mode client requires a key_file",
+		"bad.columns[0] (id): sortord must be 1, got 2",
+		"bad.columns[0] (id): primarykey columns must also set notnull",
+		"bad.columns[1] (id): duplicate dest, already used by columns[0]",
+		"bad.columns[1] (id): unknown type 'uuid'",
+		"bad.columns[2] (email): unknown length_policy 'chop'",
+		"bad: missing meta.datadatecolumn",
+		"parquet: encryption mode client can't be used with format parquet, Redshift only loads client encrypted text files",
+	}, messages)
+}
+
+func TestCreateTableDDL(t *testing.T) {
+	table := Table{
+		Destination: "students",
+		Fields: []Field{
+			{Destination: "_data_timestamp", Type: TypeTimestamp, SortOrd: 1},
+			{Destination: "id", Source: "_id", Type: TypeText, PrimaryKey: true, NotNull: true, DistKey: true},
+			{Destination: "grade", Source: "grade", Type: TypeInt},
+			{Destination: "notes", Source: "notes", Type: TypeLongText},
+			{Destination: "id", Source: "other_id", Type: TypeBigInt},
+		},
+	}
+	ddl, err := table.CreateTableDDL("mongo_raw")
+	assert.NoError(t, err)
+	assert.Equal(t, `CREATE TABLE IF NOT EXISTS "mongo_raw"."students" (
+    "_data_timestamp" TIMESTAMP SORTKEY,
+    "id" VARCHAR(256) NOT NULL DISTKEY,
+    "grade" INTEGER,
+    "notes" VARCHAR(65535),
+    PRIMARY KEY ("id")
+);
+`, ddl)
+
+	table.Fields = append(table.Fields, Field{Destination: "bad", Source: "bad", Type: "uuid"})
+	_, err = table.CreateTableDDL("mongo_raw")
+	assert.Error(t, err)
+}
+
+func TestSchemaTally(t *testing.T) {
+	tally := NewSchemaTally()
+	tally.Add(optimus.Row{"a": "short", "b": 1})
+	tally.Add(optimus.Row{"a": strings.Repeat("x", TextMaxLength+1), "b": nil})
+	tally.Add(optimus.Row{"a": "short", "b": int64(2), "c": 1.5})
+
+	assert.Equal(t, 3, tally.Rows)
+	assert.Equal(t, []string{"a", "b", "c"}, tally.SortedPaths())
+	assert.Equal(t, PathStats{Count: 3, Types: map[string]int{"string": 3}, MaxLength: TextMaxLength + 1}, *tally.Paths["a"])
+	assert.Equal(t, PathStats{Count: 3, Nulls: 1, Types: map[string]int{"int": 1, "long": 1}}, *tally.Paths["b"])
+
+	assert.Equal(t, TypeLongText, SuggestType(*tally.Paths["a"]))
+	// ties go to the alphabetically first type
+	assert.Equal(t, TypeInt, SuggestType(*tally.Paths["b"]))
+	assert.Equal(t, TypeFloat, SuggestType(*tally.Paths["c"]))
+	assert.Equal(t, TypeText, SuggestType(PathStats{Nulls: 1}))
+}
+
+func TestDriftReport(t *testing.T) {
+	table := Table{
+		Fields: []Field{
+			{Destination: "_data_timestamp"},
+			{Destination: "id", Source: "_id"},
+			{Destination: "name", Source: "name"},
+			{Destination: "gone", Source: "gone"},
+		},
+	}
+	tally := NewSchemaTally()
+	tally.Add(optimus.Row{"_id": "a", "name": "foo"})
+	tally.Add(optimus.Row{"_id": "b", "name": "bar", "new.field": int64(1)})
+
+	report := NewDriftReport(table, tally)
+	assert.True(t, report.HasDrift())
+	assert.Equal(t, 2, report.Rows)
+	assert.Equal(t, map[string]PathStats{
+		"new.field": {Count: 1, Types: map[string]int{"long": 1}},
+	}, report.NewPaths)
+	assert.Equal(t, []string{"gone"}, report.MissingPaths)
+
+	table.Fields = table.Fields[:3]
+	table.Fields = append(table.Fields, Field{Destination: "new_field", Source: "new.field"})
+	assert.False(t, NewDriftReport(table, tally).HasDrift())
+}
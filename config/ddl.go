@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// redshiftTypes maps config column types to Redshift column types
+var redshiftTypes = map[string]string{
+	TypeBoolean:   "BOOLEAN",
+	TypeInt:       "INTEGER",
+	TypeBigInt:    "BIGINT",
+	TypeFloat:     "DOUBLE PRECISION",
+	TypeTimestamp: "TIMESTAMP",
+	TypeText:      fmt.Sprintf("VARCHAR(%d)", TextMaxLength),
+	TypeLongText:  fmt.Sprintf("VARCHAR(%d)", LongTextMaxLength),
+}
+
+// CreateTableDDL returns the Redshift CREATE TABLE statement for the table's destination
+// in the given schema. If a destination is listed more than once the first column wins.
+func (t Table) CreateTableDDL(schema string) (string, error) {
+	lines := []string{}
+	primaryKeys := []string{}
+	seen := map[string]bool{}
+	for _, field := range t.Fields {
+		if field.Destination == "" || seen[field.Destination] {
+			continue
+		}
+		seen[field.Destination] = true
+
+		redshiftType, ok := redshiftTypes[field.Type]
+		if !ok {
+			return "", fmt.Errorf("column '%s' has unknown type '%s'", field.Destination, field.Type)
+		}
+		line := fmt.Sprintf("    %s %s", quoteIdentifier(field.Destination), redshiftType)
+		if field.NotNull {
+			line += " NOT NULL"
+		}
+		if field.SortOrd == 1 {
+			line += " SORTKEY"
+		}
+		if field.DistKey {
+			line += " DISTKEY"
+		}
+		lines = append(lines, line)
+		if field.PrimaryKey {
+			primaryKeys = append(primaryKeys, quoteIdentifier(field.Destination))
+		}
+	}
+	if len(primaryKeys) > 0 {
+		lines = append(lines, fmt.Sprintf("    PRIMARY KEY (%s)", strings.Join(primaryKeys, ", ")))
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (\n%s\n);\n",
+		quoteIdentifier(schema), quoteIdentifier(t.Destination), strings.Join(lines, ",\n")), nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,39 @@
+package config
+
+import "sort"
+
+// DriftReport describes how a collection's documents differ from the columns in its config
+type DriftReport struct {
+	Rows int `json:"rows"`
+	// NewPaths are flattened field paths found in documents that aren't the source of any column
+	NewPaths map[string]PathStats `json:"new_paths"`
+	// MissingPaths are column sources that weren't in any document
+	MissingPaths []string `json:"missing_paths"`
+}
+
+// HasDrift is whether the documents and config differ at all
+func (d DriftReport) HasDrift() bool {
+	return len(d.NewPaths) > 0 || len(d.MissingPaths) > 0
+}
+
+// NewDriftReport compares the paths tallied from a collection's flattened rows with the table's columns
+func NewDriftReport(t Table, tally *SchemaTally) DriftReport {
+	tally.Lock()
+	defer tally.Unlock()
+
+	whitelisted := t.FieldMap()
+	report := DriftReport{Rows: tally.Rows, NewPaths: map[string]PathStats{}, MissingPaths: []string{}}
+	for path, stats := range tally.Paths {
+		if _, ok := whitelisted[path]; !ok {
+			report.NewPaths[path] = *stats
+		}
+	}
+	for source := range whitelisted {
+		// the data date column doesn't come from the collection
+		if _, ok := tally.Paths[source]; !ok && source != "" {
+			report.MissingPaths = append(report.MissingPaths, source)
+		}
+	}
+	sort.Strings(report.MissingPaths)
+	return report
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// PathStats is what's been seen of a single flattened field path
+type PathStats struct {
+	// Count is the number of rows the path appeared in, including as null
+	Count int `json:"count"`
+	// Nulls is the number of rows the path was null in
+	Nulls int `json:"nulls"`
+	// Types counts the BSON type of each non-null value
+	Types map[string]int `json:"types"`
+	// MaxLength is the length in bytes of the longest string value
+	MaxLength int `json:"max_length"`
+}
+
+// MostCommonType is the BSON type seen most often for the path, or "null" if it's never
+// had a value. Ties go to the alphabetically first type so the result is stable.
+func (p PathStats) MostCommonType() string {
+	best := "null"
+	bestCount := 0
+	for name, count := range p.Types {
+		if count > bestCount || (count == bestCount && name < best) {
+			best = name
+			bestCount = count
+		}
+	}
+	return best
+}
+
+// SchemaTally counts the field paths and value types seen in flattened rows.
+// It's safe to add rows from multiple goroutines.
+type SchemaTally struct {
+	sync.Mutex
+	Rows  int
+	Paths map[string]*PathStats
+}
+
+// NewSchemaTally returns an empty tally
+func NewSchemaTally() *SchemaTally {
+	return &SchemaTally{Paths: map[string]*PathStats{}}
+}
+
+// Add records the paths in a row that's been through the Flattener
+func (s *SchemaTally) Add(r optimus.Row) {
+	s.Lock()
+	defer s.Unlock()
+	s.Rows++
+	for path, val := range r {
+		stats, ok := s.Paths[path]
+		if !ok {
+			stats = &PathStats{Types: map[string]int{}}
+			s.Paths[path] = stats
+		}
+		stats.Count++
+		if val == nil {
+			stats.Nulls++
+			continue
+		}
+		stats.Types[BSONTypeName(val)]++
+		if str, ok := val.(string); ok && len(str) > stats.MaxLength {
+			stats.MaxLength = len(str)
+		}
+	}
+}
+
+// SortedPaths returns every path seen in alphabetical order
+func (s *SchemaTally) SortedPaths() []string {
+	s.Lock()
+	defer s.Unlock()
+	paths := []string{}
+	for path := range s.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// BSONTypeName returns the name mongo uses for the BSON type a decoded value came from
+func BSONTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int, int32:
+		return "int"
+	case int64:
+		return "long"
+	case float64:
+		return "double"
+	case time.Time:
+		return "date"
+	case primitive.ObjectID:
+		return "objectId"
+	case []byte, primitive.Binary:
+		return "binData"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}, optimus.Row, primitive.M:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// SuggestType picks the config column type that best fits the values seen for a path
+func SuggestType(stats PathStats) string {
+	switch stats.MostCommonType() {
+	case "bool":
+		return TypeBoolean
+	case "int":
+		return TypeInt
+	case "long":
+		return TypeBigInt
+	case "double":
+		return TypeFloat
+	case "date":
+		return TypeTimestamp
+	}
+	if stats.MaxLength > TextMaxLength {
+		return TypeLongText
+	}
+	return TypeText
+}
@@ -0,0 +1,279 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	json "github.com/pquerna/ffjson/ffjson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// Column types accepted in the config
+const (
+	TypeBoolean   = "boolean"
+	TypeInt       = "int"
+	TypeBigInt    = "bigint"
+	TypeFloat     = "float"
+	TypeTimestamp = "timestamp"
+	TypeText      = "text"
+	TypeLongText  = "longtext"
+)
+
+// Types lists every column type accepted in the config
+var Types = []string{TypeBoolean, TypeInt, TypeBigInt, TypeFloat, TypeTimestamp, TypeText, TypeLongText}
+
+// ValidType reports whether a column type is one of Types
+func ValidType(columnType string) bool {
+	for _, t := range Types {
+		if t == columnType {
+			return true
+		}
+	}
+	return false
+}
+
+// Maximum sizes of text columns, in bytes since that's how Redshift measures VARCHARs
+const (
+	TextMaxLength     = 256
+	LongTextMaxLength = 65535
+)
+
+// What to do with values that are longer than their column allows
+const (
+	LengthPolicyFail     = "fail"
+	LengthPolicyTruncate = "truncate"
+	LengthPolicyNull     = "null"
+)
+
+// TimestampFormat is how timestamps are written out. It's RFC3339 with as much
+// precision as the value has, which matches how time.Time marshals to JSON.
+const TimestampFormat = time.RFC3339Nano
+
+// ColumnTypes returns a mapping of destination column to its declared type.
+// If a destination is listed more than once the first type wins.
+func (t Table) ColumnTypes() map[string]string {
+	types := map[string]string{}
+	for _, field := range t.Fields {
+		if _, ok := types[field.Destination]; field.Destination != "" && !ok {
+			types[field.Destination] = field.Type
+		}
+	}
+	return types
+}
+
+// GetTypeCoercionFn returns a function which converts each column to the type declared for it.
+// Values which can't be converted are set to null and reported to onFailure.
+// Runs after the field map.
+func GetTypeCoercionFn(t Table, onFailure func(column string, err error)) func(optimus.Row) (optimus.Row, error) {
+	types := t.ColumnTypes()
+	return func(r optimus.Row) (optimus.Row, error) {
+		for column, val := range r {
+			coerced, err := CoerceValue(types[column], val)
+			if err != nil {
+				onFailure(column, err)
+			}
+			r[column] = coerced
+		}
+		return r, nil
+	}
+}
+
+// CoerceValue converts a value decoded from mongo into the given column type.
+// Null values and columns without a type are left as they are.
+func CoerceValue(columnType string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch columnType {
+	case "":
+		return v, nil
+	case TypeText, TypeLongText:
+		return toText(v)
+	case TypeTimestamp:
+		return toTimestamp(v)
+	case TypeInt:
+		i, err := toInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, fmt.Errorf("%T value out of range for %s", v, columnType)
+		}
+		return i, nil
+	case TypeBigInt:
+		i, err := toInt(v)
+		if err != nil {
+			return nil, err
+		}
+		return i, nil
+	case TypeFloat:
+		return toFloat(v)
+	case TypeBoolean:
+		return toBool(v)
+	}
+	return nil, fmt.Errorf("unknown column type '%s'", columnType)
+}
+
+func toText(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case primitive.ObjectID:
+		return val.Hex(), nil
+	case time.Time:
+		return val.UTC().Format(TimestampFormat), nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case int:
+		return strconv.Itoa(val), nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert %T to text: %s", v, err)
+	}
+	return string(encoded), nil
+}
+
+func toTimestamp(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case time.Time:
+		return val.UTC().Format(TimestampFormat), nil
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(val))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse string as %s", TypeTimestamp)
+		}
+		return t.UTC().Format(TimestampFormat), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to %s", v, TypeTimestamp)
+}
+
+func toInt(v interface{}) (int64, error) {
+	switch val := v.(type) {
+	case int:
+		return int64(val), nil
+	case int32:
+		return int64(val), nil
+	case int64:
+		return val, nil
+	case float64:
+		if val != math.Trunc(val) || val < math.MinInt64 || val >= math.MaxInt64 {
+			return 0, fmt.Errorf("cannot convert non-integral %T to an integer", v)
+		}
+		return int64(val), nil
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse string as an integer")
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("cannot convert %T to an integer", v)
+}
+
+func toFloat(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case int:
+		return float64(val), nil
+	case int32:
+		return float64(val), nil
+	case int64:
+		return float64(val), nil
+	case float64:
+		return val, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse string as %s", TypeFloat)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to %s", v, TypeFloat)
+}
+
+func toBool(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case bool:
+		return val, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(val))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse string as %s", TypeBoolean)
+		}
+		return b, nil
+	case int, int32, int64, float64:
+		i, err := toInt(val)
+		if err != nil || (i != 0 && i != 1) {
+			return nil, fmt.Errorf("cannot convert %T other than 0 or 1 to %s", v, TypeBoolean)
+		}
+		return i == 1, nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to %s", v, TypeBoolean)
+}
+
+// MaxLength returns the maximum length in bytes of values for a column type,
+// or 0 if the type isn't limited
+func MaxLength(columnType string) int {
+	switch columnType {
+	case TypeText:
+		return TextMaxLength
+	case TypeLongText:
+		return LongTextMaxLength
+	}
+	return 0
+}
+
+// GetLengthLimitFn returns a function which applies each text column's length policy to
+// values that are too long, truncating them unless the column says otherwise. onViolation
+// is called for each value over the limit.
+// Runs after the field map and type coercion.
+func GetLengthLimitFn(t Table, onViolation func(column string)) func(optimus.Row) (optimus.Row, error) {
+	limits := map[string]int{}
+	policies := map[string]string{}
+	for column, columnType := range t.ColumnTypes() {
+		if limit := MaxLength(columnType); limit > 0 {
+			limits[column] = limit
+		}
+	}
+	for _, field := range t.Fields {
+		if _, ok := policies[field.Destination]; !ok {
+			policies[field.Destination] = field.LengthPolicy
+		}
+	}
+
+	return func(r optimus.Row) (optimus.Row, error) {
+		for column, limit := range limits {
+			val, ok := r[column].(string)
+			if !ok || len(val) <= limit {
+				continue
+			}
+			onViolation(column)
+			switch policies[column] {
+			case LengthPolicyFail:
+				return nil, fmt.Errorf("value for column '%s' is %d bytes, over the limit of %d", column, len(val), limit)
+			case LengthPolicyNull:
+				r[column] = nil
+			default:
+				r[column] = truncate(val, limit)
+			}
+		}
+		return r, nil
+	}
+}
+
+// truncate shortens a string to at most n bytes without splitting a multi-byte character
+func truncate(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
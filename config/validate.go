@@ -0,0 +1,163 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ValidationError describes a problem with a table, or one of its columns, in a config
+type ValidationError struct {
+	Table string
+	// Column is the index of the column in the table's column list, or -1 if the
+	// problem is with the table as a whole
+	Column     int
+	ColumnName string
+	Message    string
+}
+
+func (e ValidationError) Error() string {
+	if e.Column < 0 {
+		return fmt.Sprintf("%s: %s", e.Table, e.Message)
+	}
+	return fmt.Sprintf("%s.columns[%d] (%s): %s", e.Table, e.Column, e.ColumnName, e.Message)
+}
+
+// Validate checks every table in the config and returns all of the problems found,
+// ordered by table name
+func (c Config) Validate() []ValidationError {
+	names := []string{}
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := []ValidationError{}
+	for _, name := range names {
+		errs = append(errs, c[name].Validate(name)...)
+	}
+	return errs
+}
+
+// Validate checks a table config for mistakes that would break the export or the
+// Redshift load. name is the table's key in the config.
+func (t Table) Validate(name string) []ValidationError {
+	errs := []ValidationError{}
+	tableErr := func(format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Table: name, Column: -1, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if t.Destination == "" {
+		tableErr("missing dest")
+	}
+	if t.Source == "" {
+		tableErr("missing source")
+	}
+	if len(t.Fields) == 0 {
+		tableErr("no columns")
+	}
+	switch t.Meta.Format {
+	case "", FormatJSON, FormatParquet:
+	default:
+		tableErr("unknown format '%s'", t.Meta.Format)
+	}
+
+	for _, problem := range t.Meta.Encryption.Validate() {
+		tableErr("%s", problem)
+	}
+	if t.Meta.Format == FormatParquet && t.Meta.Encryption.Mode == EncryptionClient {
+		tableErr("encryption mode %s can't be used with format %s, Redshift only loads client encrypted text files", EncryptionClient, FormatParquet)
+	}
+
+	if t.Meta.DetectDrift && t.Meta.UseProjectionOptimization {
+		tableErr("detect_drift can't see fields left out by projection_optimization")
+	}
+
+	dataDateColumnFound := false
+	sortKeys := 0
+	distKeys := 0
+	seen := map[string]int{}
+	for i, field := range t.Fields {
+		columnErr := func(format string, args ...interface{}) {
+			errs = append(errs, ValidationError{
+				Table: name, Column: i, ColumnName: field.Destination, Message: fmt.Sprintf(format, args...),
+			})
+		}
+
+		if field.Destination == "" {
+			columnErr("missing dest")
+		} else if first, ok := seen[field.Destination]; ok {
+			columnErr("duplicate dest, already used by columns[%d]", first)
+		} else {
+			seen[field.Destination] = i
+		}
+
+		isDataDateColumn := field.Destination != "" && field.Destination == t.Meta.DataDateColumn
+		if isDataDateColumn {
+			dataDateColumnFound = true
+			if field.Type != TypeTimestamp {
+				columnErr("meta.datadatecolumn must be type %s", TypeTimestamp)
+			}
+		} else if field.Source == "" {
+			columnErr("missing source")
+		}
+
+		if field.Type != "" && !ValidType(field.Type) {
+			columnErr("unknown type '%s'", field.Type)
+		}
+
+		switch field.LengthPolicy {
+		case "", LengthPolicyFail, LengthPolicyTruncate, LengthPolicyNull:
+		default:
+			columnErr("unknown length_policy '%s'", field.LengthPolicy)
+		}
+		if field.LengthPolicy != "" && MaxLength(field.Type) == 0 {
+			columnErr("length_policy only applies to %s and %s columns", TypeText, TypeLongText)
+		}
+
+		switch field.SortOrd {
+		case 0:
+		case 1:
+			sortKeys++
+		default:
+			columnErr("sortord must be 1, got %d", field.SortOrd)
+		}
+		if field.DistKey {
+			distKeys++
+		}
+		if field.PrimaryKey && !field.NotNull {
+			columnErr("primarykey columns must also set notnull")
+		}
+	}
+
+	if t.Meta.DataDateColumn == "" {
+		tableErr("missing meta.datadatecolumn")
+	} else if !dataDateColumnFound {
+		tableErr("meta.datadatecolumn '%s' is not one of the columns", t.Meta.DataDateColumn)
+	}
+	if sortKeys > 1 {
+		tableErr("only one column can have a sortord, found %d", sortKeys)
+	}
+	if distKeys > 1 {
+		tableErr("only one column can be the distkey, found %d", distKeys)
+	}
+	return errs
+}
+
+// Validate returns the problems with an encryption config
+func (e Encryption) Validate() []string {
+	problems := []string{}
+	switch e.Mode {
+	case "", EncryptionSSES3, EncryptionSSEKMS, EncryptionClient, EncryptionNone:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown encryption mode '%s'", e.Mode))
+	}
+	if (e.KMSKeyID != "" || len(e.KMSContext) > 0) && e.Mode != EncryptionSSEKMS {
+		problems = append(problems, fmt.Sprintf("encryption kms_key_id and kms_context only apply to mode %s", EncryptionSSEKMS))
+	}
+	if e.Mode == EncryptionClient && e.KeyFile == "" {
+		problems = append(problems, fmt.Sprintf("encryption mode %s requires a key_file", EncryptionClient))
+	} else if e.Mode != EncryptionClient && e.KeyFile != "" {
+		problems = append(problems, fmt.Sprintf("encryption key_file only applies to mode %s", EncryptionClient))
+	}
+	return problems
+}
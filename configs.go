@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Clever/mongo-to-s3/cluster"
+	"github.com/Clever/mongo-to-s3/store"
+)
+
+// exportConfig is an export config along with where it came from
+type exportConfig struct {
+	// Name names the config's copy and identifies it in the run report
+	Name string
+	// Source is where the config was read from
+	Source string
+	Data   string
+	// Cluster is the cluster the config belongs to. It's only set for configs looked up by
+	// cluster name, since there's no telling which cluster a file is for.
+	Cluster string
+}
+
+// isConfigName checks whether --config is a cluster's name rather than a path or URL
+func isConfigName(ref string) bool {
+	ext := filepath.Ext(ref)
+	return !strings.Contains(ref, "://") && !strings.ContainsRune(ref, filepath.Separator) && ext != ".yml" && ext != ".yaml"
+}
+
+// loadConfig reads the export config given by --config: the name of a cluster in the
+// registry, a local path, or an s3:// or file:// URL. Files are read with the same stores
+// output is written to.
+func loadConfig(ref string, registry *cluster.Registry) (exportConfig, error) {
+	if isConfigName(ref) {
+		c, err := registry.Lookup(ref)
+		if err != nil {
+			return exportConfig{}, err
+		}
+		if c.Config == "" {
+			return exportConfig{}, fmt.Errorf("cluster '%s' has no config", ref)
+		}
+		return exportConfig{Name: ref, Source: fmt.Sprintf("cluster %s (%s)", ref, c.Source), Data: c.Config, Cluster: ref}, nil
+	}
+
+	source := ref
+	if !strings.Contains(ref, "://") {
+		abs, err := filepath.Abs(ref)
+		if err != nil {
+			return exportConfig{}, err
+		}
+		source = "file://" + filepath.ToSlash(abs)
+	}
+	data, err := store.ReadURL(source)
+	if err == store.ErrNotFound {
+		return exportConfig{}, fmt.Errorf("config '%s' not found", ref)
+	} else if err != nil {
+		return exportConfig{}, fmt.Errorf("failed to read config '%s': %s", ref, err)
+	}
+	// the file's name without its extension, e.g. sis for s3://bucket/configs/sis.yml
+	base := filepath.Base(filepath.FromSlash(strings.SplitN(source, "?", 2)[0]))
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+	return exportConfig{Name: name, Source: source, Data: string(data)}, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Clever/mongo-to-s3/cluster"
+	"github.com/Clever/mongo-to-s3/config"
+)
+
+// ddlCommand prints the Redshift CREATE TABLE statement for a collection's export config,
+// so the table definition can't drift from what we export. It returns the exit code.
+//
+//	mongo-to-s3 ddl --config NAME --collection X
+func ddlCommand(args []string) int {
+	fs := flag.NewFlagSet("ddl", flag.ExitOnError)
+	name := fs.String("config", "", "The export config: a cluster's name, a local path or an s3:// url (required)")
+	collection := fs.String("collection", "", "The collection entry in the config (required)")
+	fs.Parse(args)
+	if *name == "" || *collection == "" {
+		fs.Usage()
+		return 2
+	}
+
+	registry, err := cluster.FromEnv(os.Environ())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	c, err := loadConfig(*name, registry)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	conf, err := config.ParseYAML([]byte(c.Data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config '%s': %s\n", *name, err)
+		return 1
+	}
+	table, ok := conf[*collection]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "collection '%s' not found in config '%s'\n", *collection, *name)
+		return 1
+	}
+
+	ddl, err := table.CreateTableDDL(redshiftSchema)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *collection, err)
+		return 1
+	}
+	fmt.Print(ddl)
+	return 0
+}
@@ -0,0 +1,235 @@
+package exporter
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/Clever/mongo-to-s3/store"
+	json "github.com/pquerna/ffjson/ffjson"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// checkpoint is the progress of an export. It's saved after every data file is written so
+// a failed run can be resumed without redoing the files that were finished.
+type checkpoint struct {
+	RunID       string `json:"run_id"`
+	Timestamp   string `json:"timestamp"`
+	Destination string `json:"destination"`
+	Incremental bool   `json:"incremental"`
+	// PreviousWatermark is the watermark the export's query was built from, and
+	// NextWatermark the one written once it's finished
+	PreviousWatermark *watermark             `json:"previous_watermark,omitempty"`
+	NextWatermark     *watermark             `json:"next_watermark,omitempty"`
+	Partitions        []*partitionCheckpoint `json:"partitions"`
+
+	mu sync.Mutex
+	// output is where the checkpoint is saved. nil keeps it in memory only.
+	output store.ObjectStore
+}
+
+// partitionCheckpoint is the progress of a single _id range
+type partitionCheckpoint struct {
+	Min *typedValue `json:"min,omitempty"`
+	Max *typedValue `json:"max,omitempty"`
+	// LastID is the _id of the last document in the finished segments. It's nil if
+	// there are none, or if the _ids weren't all comparable, in which case the
+	// partition is started over when the export is resumed.
+	LastID   *typedValue         `json:"last_id,omitempty"`
+	Segments []segmentCheckpoint `json:"segments"`
+	Done     bool                `json:"done"`
+}
+
+// segmentCheckpoint is a finished data file
+type segmentCheckpoint struct {
+	Staged string `json:"staged"`
+	Final  string `json:"final"`
+	Rows   int64  `json:"rows"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// checkpointFilename is where the checkpoint of an unfinished export lives. There's only
+// ever one per destination table, since a new run replaces it.
+func checkpointFilename(collectionName string) string {
+	return fmt.Sprintf("mongo_raw/%s/_checkpoint.json", collectionName)
+}
+
+// newCheckpoint returns an empty checkpoint for a new run
+func newCheckpoint(runID, timestamp, collectionName string) *checkpoint {
+	return &checkpoint{RunID: runID, Timestamp: timestamp, Destination: collectionName}
+}
+
+// setRanges records the _id ranges the run is split into
+func (c *checkpoint) setRanges(ranges []idRange) error {
+	partitions := []*partitionCheckpoint{}
+	for _, r := range ranges {
+		p := &partitionCheckpoint{Segments: []segmentCheckpoint{}}
+		for _, bound := range []struct {
+			value interface{}
+			dest  **typedValue
+		}{{r.Min, &p.Min}, {r.Max, &p.Max}} {
+			if bound.value == nil {
+				continue
+			}
+			v, err := encodeValue(bound.value)
+			if err != nil {
+				return err
+			}
+			*bound.dest = &v
+		}
+		partitions = append(partitions, p)
+	}
+	c.Partitions = partitions
+	return nil
+}
+
+// readCheckpoint fetches the checkpoint of an unfinished export. It returns nil if there isn't one.
+func readCheckpoint(output store.ObjectStore, collectionName string) (*checkpoint, error) {
+	data, err := output.Get(checkpointFilename(collectionName))
+	if err == store.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ranges rebuilds the _id ranges the checkpoint's partitions cover
+func (c *checkpoint) ranges() ([]idRange, error) {
+	ranges := make([]idRange, len(c.Partitions))
+	for i, p := range c.Partitions {
+		var err error
+		if p.Min != nil {
+			if ranges[i].Min, err = decodeValue(*p.Min); err != nil {
+				return nil, err
+			}
+		}
+		if p.Max != nil {
+			if ranges[i].Max, err = decodeValue(*p.Max); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// update applies fn to the checkpoint and saves it. Partitions are exported concurrently,
+// so they have to go through here to change their progress.
+func (c *checkpoint) update(fn func()) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn()
+	if c.output == nil {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return c.output.PutBytes(checkpointFilename(c.Destination), data)
+}
+
+// files lists the finished data files in order
+func (c *checkpoint) files() []segmentCheckpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files := []segmentCheckpoint{}
+	for _, p := range c.Partitions {
+		files = append(files, p.Segments...)
+	}
+	return files
+}
+
+// discardCheckpoint deletes a checkpoint along with the files staged by its run
+func discardCheckpoint(output store.ObjectStore, c *checkpoint) {
+	cleanupStaging(output, stagingPrefix(c.Destination, c.RunID))
+	if err := output.Delete(checkpointFilename(c.Destination)); err != nil {
+		log.ErrorD("checkpoint-delete-error", logger.M{"collection": c.Destination, "error": err.Error()})
+	}
+}
+
+// segmentIndex is the file index of a partition's segment. The first segment keeps the
+// partition's plain index so exports that fit in one segment are named as they always were.
+func segmentIndex(partition, segment int) string {
+	if segment == 0 {
+		return strconv.Itoa(partition)
+	}
+	return fmt.Sprintf("%d_%d", partition, segment)
+}
+
+// segmenter splits a source sorted by _id into segments of at most size rows, each read
+// through to the end before the next one starts. It keeps track of the last _id handed
+// out, which is where the next segment starts if the export is resumed.
+type segmenter struct {
+	source optimus.Table
+	// size is the most rows in a segment. 0 puts everything in a single segment.
+	size   int
+	lastID interface{}
+	// mixed is set if the _ids weren't all comparable, so lastID can't be used to resume
+	mixed bool
+	done  bool
+}
+
+// next returns a table of the next segment's rows. The segment also ends early once full
+// returns true, which is checked before each row after the first. full may be nil.
+// lastID, mixed and done are only up to date once the table's rows have all been read.
+func (s *segmenter) next(full func() bool) optimus.Table {
+	t := &segmentTable{rows: make(chan optimus.Row), stop: make(chan struct{})}
+	go func() {
+		defer close(t.rows)
+		for n := 0; s.size <= 0 || n < s.size; n++ {
+			if n > 0 && full != nil && full() {
+				return
+			}
+			var row optimus.Row
+			var ok bool
+			select {
+			case row, ok = <-s.source.Rows():
+			case <-t.stop:
+				return
+			}
+			if !ok {
+				s.done = true
+				t.err = s.source.Err()
+				return
+			}
+			// the row is changed in place further down the pipeline, so read it first
+			id := row["_id"]
+			select {
+			case t.rows <- row:
+			case <-t.stop:
+				return
+			}
+			if s.lastID != nil && !sameTypeClass([]interface{}{s.lastID, id}) {
+				s.mixed = true
+			}
+			s.lastID = id
+		}
+	}()
+	return t
+}
+
+// segmentTable is an optimus table over one segment of a segmenter's source
+type segmentTable struct {
+	rows     chan optimus.Row
+	err      error
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (t *segmentTable) Rows() <-chan optimus.Row {
+	return t.rows
+}
+
+func (t *segmentTable) Err() error {
+	return t.err
+}
+
+func (t *segmentTable) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
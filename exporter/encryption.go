@@ -0,0 +1,71 @@
+package exporter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/store"
+	json "github.com/pquerna/ffjson/ffjson"
+)
+
+// EncryptionOverrides are per-run encryption settings. Any that are set take
+// precedence over the table's meta.encryption.
+type EncryptionOverrides struct {
+	Mode       string
+	KMSKeyID   string
+	KMSContext string // JSON object, e.g. {"table":"students"}
+	KeyFile    string
+}
+
+// resolveEncryption merges the run's overrides over the table's config and returns the
+// mode along with the store settings for it
+func resolveEncryption(conf config.Encryption, overrides EncryptionOverrides) (string, store.Encryption, error) {
+	if overrides.Mode != "" && overrides.Mode != conf.Mode {
+		// the config's key settings are for a different mode, so don't carry them over
+		conf = config.Encryption{Mode: overrides.Mode}
+	}
+	if overrides.KMSKeyID != "" {
+		conf.KMSKeyID = overrides.KMSKeyID
+	}
+	if overrides.KMSContext != "" {
+		context := map[string]string{}
+		if err := json.Unmarshal([]byte(overrides.KMSContext), &context); err != nil {
+			return "", store.Encryption{}, fmt.Errorf("kmscontext must be a JSON object of strings: %s", err)
+		}
+		conf.KMSContext = context
+	}
+	if overrides.KeyFile != "" {
+		conf.KeyFile = overrides.KeyFile
+	}
+	// the default leaves the store to pick, so s3 compatible services that can't do sse
+	// still work unless it was asked for
+	explicit := conf.Mode != ""
+	if conf.Mode == "" {
+		conf.Mode = config.EncryptionSSES3
+	}
+
+	if problems := conf.Validate(); len(problems) > 0 {
+		return "", store.Encryption{}, fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+
+	switch conf.Mode {
+	case config.EncryptionSSES3:
+		if !explicit {
+			return conf.Mode, store.Encryption{}, nil
+		}
+		return conf.Mode, store.Encryption{SSE: store.SSEAES256}, nil
+	case config.EncryptionSSEKMS:
+		return conf.Mode, store.Encryption{SSE: store.SSEKMS, KMSKeyID: conf.KMSKeyID, KMSContext: conf.KMSContext}, nil
+	case config.EncryptionNone:
+		return conf.Mode, store.Encryption{SSE: store.SSENone}, nil
+	case config.EncryptionClient:
+		key, err := store.ReadKeyFile(conf.KeyFile)
+		if err != nil {
+			return "", store.Encryption{}, err
+		}
+		// s3 still encrypts at rest as usual on top of the client encryption
+		return conf.Mode, store.Encryption{ClientKey: key}, nil
+	}
+	return "", store.Encryption{}, fmt.Errorf("unknown encryption mode '%s'", conf.Mode)
+}
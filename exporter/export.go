@@ -0,0 +1,165 @@
+package exporter
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/mongosource"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+	"gopkg.in/Clever/optimus.v3"
+	jsonsink "gopkg.in/Clever/optimus.v3/sinks/json"
+	"gopkg.in/Clever/optimus.v3/transformer"
+)
+
+// configuredOptimusTable returns the documents matching the query as an optimus table.
+// Stopping the table kills the cursor, e.g. if the export stops before reading everything.
+func configuredOptimusTable(ctx context.Context, db *mongo.Database, table config.Table, query bson.M, sorted bool) (optimus.Table, error) {
+	opts := options.Find().SetBatchSize(1000)
+	if table.Meta.UseProjectionOptimization == true {
+		// Create a projection to only pull the fields we're interested in
+		fields := bson.M{}
+		for _, f := range table.Fields {
+			if f.Source != "" {
+				fields[f.Source] = 1
+			}
+		}
+		opts.SetProjection(fields)
+	}
+	if sorted {
+		// checkpoints record the last _id written, which only means something in _id order
+		opts.SetSort(bson.D{{Key: "_id", Value: 1}})
+	}
+
+	cursor, err := db.Collection(table.Source).Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	return mongosource.New(ctx, cursor), nil
+}
+
+func formatFilename(timestamp, collectionName, fileIndex, extension string) string {
+	if fileIndex != "" {
+		// add underscore for readability
+		fileIndex = fmt.Sprintf("_%s", fileIndex)
+	}
+	t, _ := time.Parse(time.RFC3339, timestamp)
+	filePath := fmt.Sprintf("mongo_raw/%s/_data_timestamp_year=%02d/_data_timestamp_month=%02d/_data_timestamp_day=%02d/",
+		collectionName, t.Year(), int(t.Month()), t.Day())
+	fileName := fmt.Sprintf("mongo_raw_%s_%s%s%s", collectionName, timestamp, fileIndex, extension)
+	return filePath + fileName
+}
+
+// dataFileExtension is the file extension for data files in the given output format
+func dataFileExtension(format string) string {
+	if format == config.FormatParquet {
+		return ".parquet"
+	}
+	return ".json.gz"
+}
+
+// newDataSink returns a sink writing rows in the table's output format, along with a
+// function that flushes the output and must be called once the sink is done. targetSize is
+// the file size the output will be rolled over at, if any.
+func newDataSink(out io.Writer, table config.Table, targetSize int64) (optimus.Sink, func() error, error) {
+	switch table.Meta.Format {
+	case config.FormatParquet:
+		// parquet compresses its own pages, so there's no need to gzip on top of it
+		return parquetSink(out, table, parquetRowGroupSize(targetSize)), func() error { return nil }, nil
+	case "", config.FormatJSON:
+		zippedOutput, err := gzip.NewWriterLevel(out, gzip.BestSpeed) // sorcery
+		if err != nil {
+			return nil, nil, err
+		}
+		return jsonsink.New(zippedOutput), zippedOutput.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unknown output format '%s'", table.Meta.Format)
+}
+
+// columnCounts is a count of events per column that is safe to share between partitions
+type columnCounts struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+func newColumnCounts() *columnCounts {
+	return &columnCounts{counts: map[string]int64{}}
+}
+
+// add increments the count for a column and returns the new count
+func (c *columnCounts) add(column string) int64 {
+	c.Lock()
+	defer c.Unlock()
+	c.counts[column]++
+	return c.counts[column]
+}
+
+// snapshot returns a copy of the current counts
+func (c *columnCounts) snapshot() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+	counts := map[string]int64{}
+	for column, count := range c.counts {
+		counts[column] = count
+	}
+	return counts
+}
+
+// exportStats collects data problems found while exporting
+type exportStats struct {
+	coercionFailures *columnCounts
+	lengthViolations *columnCounts
+	// schema tallies every flattened path for drift detection. It's nil if that's turned off.
+	schema *config.SchemaTally
+}
+
+func newExportStats() *exportStats {
+	return &exportStats{coercionFailures: newColumnCounts(), lengthViolations: newColumnCounts()}
+}
+
+// exportData writes the rows in source to the sink, converted as configured by the table.
+// It stops with the context's error if the context is cancelled.
+func exportData(ctx context.Context, source optimus.Table, table config.Table, sink optimus.Sink, timestamp string, stats *exportStats) (int, error) {
+	rows := 0
+	datePopulator := config.GetPopulateDateFn(table.Meta.DataDateColumn, timestamp)
+	existentialTransformer := config.GetExistentialTransformerFn(table)
+	columnTypes := table.ColumnTypes()
+	typeCoercer := config.GetTypeCoercionFn(table, func(column string, err error) {
+		// only log the first failure for each column, the totals are logged at the end
+		if stats.coercionFailures.add(column) == 1 {
+			log.WarnD("type-coercion-error", logger.M{"column": column, "type": columnTypes[column], "error": err.Error()})
+		}
+	})
+	lengthLimiter := config.GetLengthLimitFn(table, func(column string) {
+		stats.lengthViolations.add(column)
+	})
+	flattened := transformer.New(source).
+		Map(func(d optimus.Row) (optimus.Row, error) {
+			return d, ctx.Err()
+		}).
+		Map(config.Flattener())
+	if stats.schema != nil {
+		flattened = flattened.Map(func(d optimus.Row) (optimus.Row, error) {
+			stats.schema.Add(d)
+			return d, nil
+		})
+	}
+	err := flattened.
+		Map(existentialTransformer). // convert PII to boolean exists or not
+		Fieldmap(table.FieldMap()).
+		Map(typeCoercer).   // convert values to the column types in the config
+		Map(lengthLimiter). // make sure text fits in its column
+		Map(datePopulator). // add in the _data_timestamp, etc
+		Map(func(d optimus.Row) (optimus.Row, error) {
+			rows = rows + 1
+			return d, nil
+		}).Sink(sink)
+	return rows, err
+}
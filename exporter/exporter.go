@@ -0,0 +1,567 @@
+// Package exporter exports a mongo collection to an object store as data files and a
+// manifest for a Redshift load, as configured by a table in a mongo-to-s3 config.
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+	"gopkg.in/Clever/optimus.v3"
+	"gopkg.in/Clever/optimus.v3/transforms"
+)
+
+var log = logger.New("mongo-to-s3")
+
+// Options configure a single export
+type Options struct {
+	// ConfigName is the name of the config, used for the name of its copy and in the report
+	ConfigName string
+	// Config is the YAML config. It's copied next to the data files for the load.
+	Config string
+	// ConfigSource is where the config was read from, noted at the top of its copy
+	ConfigSource string
+	// Collection is the table in the config to export
+	Collection string
+	// Output is where the data files, manifest and everything else are written
+	Output store.ObjectStore
+	// NumFiles is how many partitions to split the collection into, each read in parallel
+	// and written to its own data files. Defaults to 1.
+	NumFiles int
+	// TargetFileSize rolls over to a new data file once the current one has this many
+	// compressed bytes. 0 doesn't limit the size of files.
+	TargetFileSize int64
+	// Timestamp is the data date, in RFC3339. Defaults to now rounded to the nearest hour.
+	Timestamp string
+	// Encryption overrides the table's meta.encryption
+	Encryption EncryptionOverrides
+	// IsFresh is called with the destination table before anything is read. If it returns
+	// true the table was loaded recently, so the export is skipped. nil never skips.
+	IsFresh func(destination string) bool
+	// CheckpointRows is how many rows are written to each data file, with progress saved
+	// after each one so a failed export can be resumed. 0 turns checkpoints off. With
+	// checkpoints on each partition is read sorted by _id, which is slower than reading
+	// in natural order.
+	CheckpointRows int
+	// Resume picks up a failed export from its checkpoint, keeping the files it finished.
+	// The checkpoint's timestamp is used, and Timestamp has to match it if set.
+	Resume bool
+}
+
+// Result describes a finished export
+type Result struct {
+	// Skipped is set if the export was skipped because IsFresh returned true
+	Skipped     bool
+	Destination string
+	Timestamp   string
+	// ConfigURL is the URL of the config's copy
+	ConfigURL string
+	// ManifestURL is the URL of the manifest listing the data files
+	ManifestURL string
+	// JSONPathsURL is the URL of the JSONPaths file for loading JSON data files. It's
+	// empty for other formats.
+	JSONPathsURL string
+	// ClientEncrypted is set if the data files are client encrypted, so the load needs
+	// COPY's ENCRYPTED and MASTER_SYMMETRIC_KEY options
+	ClientEncrypted bool
+	// Incremental is set if only documents past the last watermark were exported
+	Incremental      bool
+	RowsWritten      int64
+	LengthViolations map[string]int64
+}
+
+// Exporter exports collections from a single mongo cluster
+type Exporter struct {
+	// Dial connects to the cluster, returning the database to export from. It's only
+	// called once an export is known to be needed.
+	Dial func(ctx context.Context) (*mongo.Database, error)
+	// Host is the cluster's hosts, recorded in the run report
+	Host string
+	// Version is the version of the exporter, recorded in the run report
+	Version string
+}
+
+// New returns an Exporter for the cluster reached by dial
+func New(dial func(ctx context.Context) (*mongo.Database, error), host, version string) *Exporter {
+	return &Exporter{Dial: dial, Host: host, Version: version}
+}
+
+// defaultTimestamp is the current time rounded to the nearest hour
+func defaultTimestamp() string {
+	return time.Now().UTC().Add(-1 * time.Hour / 2).Round(time.Hour).Format(time.RFC3339)
+}
+
+// Run exports the collection in opts. Files are only published once the whole export
+// has been verified, so a failed run doesn't leave partial output for the load.
+func (e *Exporter) Run(ctx context.Context, opts Options) (Result, error) {
+	startTime := time.Now().UTC()
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if opts.Output == nil {
+		return Result{}, fmt.Errorf("no output store")
+	}
+	numFiles := opts.NumFiles
+	if numFiles == 0 {
+		numFiles = 1
+	} else if numFiles < 0 {
+		return Result{}, fmt.Errorf("must specify a number of output file parts >= 1")
+	}
+	if opts.Timestamp != "" {
+		if _, err := time.Parse(time.RFC3339, opts.Timestamp); err != nil {
+			return Result{}, fmt.Errorf("invalid timestamp '%s': %s", opts.Timestamp, err)
+		}
+	}
+	if opts.TargetFileSize < 0 {
+		return Result{}, fmt.Errorf("target file size must be >= 0")
+	}
+	checkpointRows := opts.CheckpointRows
+	if checkpointRows < 0 {
+		return Result{}, fmt.Errorf("checkpoint rows must be >= 0")
+	} else if opts.Resume && checkpointRows == 0 {
+		return Result{}, fmt.Errorf("resuming an export requires checkpoints")
+	}
+
+	conf, err := config.ParseYAML([]byte(opts.Config))
+	if err != nil {
+		return Result{}, fmt.Errorf("invalid config '%s': %s", opts.ConfigName, err)
+	}
+	if opts.Collection == "" {
+		return Result{}, fmt.Errorf("no collection specified")
+	}
+	table, ok := conf[opts.Collection]
+	if !ok {
+		return Result{}, fmt.Errorf("collection '%s' not found in config '%s'", opts.Collection, opts.ConfigName)
+	}
+	switch table.Meta.Format {
+	case "", config.FormatJSON, config.FormatParquet:
+	default:
+		return Result{}, fmt.Errorf("unknown format '%s'", table.Meta.Format)
+	}
+	// every value of a column with an unknown type would fail to convert and be nulled
+	for _, field := range table.Fields {
+		if field.Type != "" && !config.ValidType(field.Type) {
+			return Result{}, fmt.Errorf("column '%s' has unknown type '%s'", field.Destination, field.Type)
+		}
+	}
+
+	encryptionMode, encryption, err := resolveEncryption(table.Meta.Encryption, opts.Encryption)
+	if err != nil {
+		return Result{}, err
+	}
+	if encryption.ClientKey != nil && table.Meta.Format == config.FormatParquet {
+		return Result{}, fmt.Errorf("encryption mode %s can't be used with format %s, Redshift only loads client encrypted text files", encryptionMode, config.FormatParquet)
+	}
+	// only the data files are client encrypted. The manifest and jsonpaths have to be
+	// readable by the load, and the watermark and checkpoint by later runs whatever their
+	// encryption, so everything else just gets the server side settings.
+	dataOutput, err := store.WithEncryption(opts.Output, encryption)
+	if err != nil {
+		return Result{}, err
+	}
+	serverSide := encryption
+	serverSide.ClientKey = nil
+	output, err := store.WithEncryption(opts.Output, serverSide)
+	if err != nil {
+		return Result{}, err
+	}
+	log.InfoD("encryption", logger.M{"mode": encryptionMode, "kms-key-id": encryption.KMSKeyID})
+
+	saved, err := readCheckpoint(output, table.Destination)
+	if err != nil && opts.Resume {
+		return Result{}, fmt.Errorf("failed to read checkpoint: %s", err)
+	} else if err != nil {
+		// a new run replaces the checkpoint anyway, so it's only in the way of a resume
+		log.WarnD("checkpoint-read-error", logger.M{"collection": table.Destination, "error": err.Error()})
+		saved = nil
+	}
+	var resumed *checkpoint
+	timestamp := opts.Timestamp
+	if opts.Resume && saved != nil {
+		if timestamp != "" && timestamp != saved.Timestamp {
+			return Result{}, fmt.Errorf("checkpoint is for timestamp %s, not %s", saved.Timestamp, timestamp)
+		}
+		resumed = saved
+		timestamp = saved.Timestamp
+		log.InfoD("resuming-export", logger.M{"collection": table.Destination, "run-id": saved.RunID, "timestamp": timestamp})
+	} else if opts.Resume {
+		log.WarnD("no-checkpoint-found", logger.M{"collection": table.Destination})
+	}
+	if timestamp == "" {
+		timestamp = defaultTimestamp()
+	}
+	configURL, err := copyConfigFile(output, timestamp, opts.Config, opts.ConfigName, opts.ConfigSource)
+	if err != nil {
+		return Result{}, err
+	}
+	result := Result{Destination: table.Destination, Timestamp: timestamp, ConfigURL: configURL, ClientEncrypted: encryption.ClientKey != nil}
+
+	report := &runReport{
+		Version:          e.Version,
+		Config:           opts.ConfigName,
+		Collection:       opts.Collection,
+		Destination:      table.Destination,
+		MongoHost:        e.Host,
+		Timestamp:        timestamp,
+		StartTime:        startTime,
+		DebounceDecision: debounceSkipped,
+		Encryption:       encryptionMode,
+		Files:            []fileReport{},
+	}
+	reportFilename := formatFilename(timestamp, table.Destination, "", ".report.json")
+
+	// After doing config validations, we can check for debouncing
+	if opts.IsFresh != nil {
+		report.DebounceDecision = debounceStale
+		if opts.IsFresh(table.Destination) {
+			report.DebounceDecision = debounceFresh
+			result.Skipped = true
+			return result, uploadReport(ctx, report, output, reportFilename)
+		}
+	}
+
+	db, err := e.Dial(ctx)
+	if err != nil {
+		return Result{}, fmt.Errorf("mongo connection failed: %s", err)
+	}
+	defer db.Client().Disconnect(context.Background())
+	log.Info("mongo-connection-successful")
+
+	mongoQuery := bson.M{}
+	var previousWatermark, newWatermark *watermark
+	if table.Meta.IncrementalField != "" {
+		if resumed != nil {
+			// the resumed run's files were read with its watermarks, so stick with them
+			previousWatermark, newWatermark = resumed.PreviousWatermark, resumed.NextWatermark
+		} else if previousWatermark, err = readWatermark(output, table.Destination); err != nil {
+			return Result{}, fmt.Errorf("failed to read watermark: %s", err)
+		}
+		mongoQuery, result.Incremental, err = incrementalQuery(table.Meta.IncrementalField, previousWatermark)
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to parse watermark: %s", err)
+		}
+		if resumed == nil {
+			newWatermark, err = nextWatermark(ctx, db, table, mongoQuery, timestamp)
+			if err != nil {
+				return Result{}, fmt.Errorf("failed to look up watermark: %s", err)
+			}
+		}
+		log.InfoD("incremental-export", logger.M{
+			"field": table.Meta.IncrementalField, "incremental": result.Incremental, "query": fmt.Sprintf("%v", mongoQuery),
+		})
+	}
+	report.Incremental = result.Incremental
+
+	cp := resumed
+	if cp == nil {
+		if saved != nil {
+			// a new run replaces an unfinished one, which would never be published
+			log.InfoD("discarding-checkpoint", logger.M{"collection": table.Destination, "run-id": saved.RunID})
+			discardCheckpoint(output, saved)
+		}
+		cp = newCheckpoint(newRunID(startTime), timestamp, table.Destination)
+		cp.Incremental = result.Incremental
+		cp.PreviousWatermark, cp.NextWatermark = previousWatermark, newWatermark
+	}
+	if checkpointRows > 0 {
+		cp.output = output
+	}
+	// data files are written to a staging prefix first and only published to their
+	// final keys once the whole export has been verified, so a failed run never leaves
+	// a partial set of files where the load will pick them up. With checkpoints on they're
+	// kept if the run fails so it can be resumed.
+	finished := false
+	defer func() {
+		if finished {
+			return
+		}
+		if cp.output != nil {
+			log.WarnD("export-checkpointed", logger.M{
+				"collection": table.Destination, "run-id": cp.RunID, "checkpoint": output.URL(checkpointFilename(table.Destination)),
+			})
+			return
+		}
+		cleanupStaging(output, stagingPrefix(table.Destination, cp.RunID))
+	}()
+
+	stats := newExportStats()
+	if table.Meta.DetectDrift {
+		stats.schema = config.NewSchemaTally()
+	}
+	if err := e.export(ctx, db, table, dataOutput, mongoQuery, numFiles, checkpointRows, opts.TargetFileSize, timestamp, report, stats, cp); err != nil {
+		return Result{}, err
+	}
+	result.RowsWritten = report.RowsWritten
+	result.LengthViolations = report.LengthViolations
+
+	if stats.schema != nil {
+		if err := uploadDriftReport(ctx, output, timestamp, table, stats.schema); err != nil {
+			return Result{}, err
+		}
+	}
+	if table.Meta.Format == "" || table.Meta.Format == config.FormatJSON {
+		// lets COPY map keys to columns in a fixed order, even when rows leave some out
+		if result.JSONPathsURL, err = uploadJSONPaths(ctx, output, timestamp, table); err != nil {
+			return Result{}, err
+		}
+	}
+	// we always upload a manifest including the files we just created. It's written
+	// after the files are published, since it's what the load looks for.
+	manifestFilename := formatFilename(timestamp, table.Destination, "", ".manifest")
+	manifestReader, err := createManifest(output, report.Files)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to create manifest: %s", err)
+	}
+	if err := uploadFile(ctx, manifestReader, output, manifestFilename); err != nil {
+		return Result{}, err
+	}
+	result.ManifestURL = output.URL(manifestFilename)
+
+	// only move the watermark forward once everything it covers has been written
+	if newWatermark != nil {
+		if err := writeWatermark(output, table.Destination, *newWatermark); err != nil {
+			return Result{}, fmt.Errorf("failed to write watermark: %s", err)
+		}
+	}
+	discardCheckpoint(output, cp)
+	finished = true
+
+	if err := uploadReport(ctx, report, output, reportFilename); err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
+
+// export writes the collection to data files under a staging prefix and publishes them to
+// their final keys once the row counts have been verified. Each partition is written as a
+// series of segments of up to checkpointRows rows and roughly targetFileSize bytes, with the
+// checkpoint updated after each one. Partitions and segments the checkpoint already has are
+// skipped. The published files are added to the report.
+func (e *Exporter) export(ctx context.Context, db *mongo.Database, table config.Table, output store.ObjectStore, mongoQuery bson.M,
+	numFiles, checkpointRows int, targetFileSize int64, timestamp string, report *runReport, stats *exportStats, cp *checkpoint) error {
+	if cp.Partitions == nil {
+		// we want to split up the collection for performance reasons, with each range of
+		// _ids read by its own cursor and written to its own files
+		ranges, err := partitionCollection(ctx, db, table, mongoQuery, numFiles)
+		if err != nil {
+			return fmt.Errorf("failed to partition collection: %s", err)
+		}
+		if err := cp.setRanges(ranges); err != nil {
+			return fmt.Errorf("failed to checkpoint partitions: %s", err)
+		}
+	}
+	ranges, err := cp.ranges()
+	if err != nil {
+		return fmt.Errorf("invalid checkpoint: %s", err)
+	}
+	// save before anything is staged, so a failed run can always be resumed or cleaned up
+	if err := cp.update(func() {}); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %s", err)
+	}
+	log.InfoD("partitioned-collection", logger.M{"collection": table.Source, "partitions": len(ranges)})
+	log.InfoD("staging-files", logger.M{"run-id": cp.RunID, "prefix": output.URL(stagingPrefix(table.Destination, cp.RunID))})
+
+	// verify total rows match sum of written
+	var totalSummedRows int64
+	var totalMongoRows int64
+	exportPartition := func(index int, r idRange) error {
+		p := cp.Partitions[index]
+		query := r.query(mongoQuery)
+		var lastID interface{}
+		if p.LastID != nil {
+			var err error
+			if lastID, err = decodeValue(*p.LastID); err != nil {
+				return fmt.Errorf("invalid checkpoint: %s", err)
+			}
+			// every _id up to here was the same type, so anything not below it is left
+			query = bson.M{"$and": []bson.M{query, {"_id": bson.M{"$not": bson.M{"$lte": lastID}}}}}
+			log.InfoD("resuming-partition", logger.M{"partition": index, "segments": len(p.Segments)})
+		} else if len(p.Segments) > 0 {
+			// there's no telling where the finished segments stopped, so start over
+			log.WarnD("restarting-partition", logger.M{"partition": index, "segments": len(p.Segments)})
+			if err := cp.update(func() { p.Segments = []segmentCheckpoint{} }); err != nil {
+				return fmt.Errorf("failed to save checkpoint: %s", err)
+			}
+		}
+
+		// each partition reads its own cursor, which the client's pool runs in parallel
+		mongoSource, err := configuredOptimusTable(ctx, db, table, query, checkpointRows > 0)
+		if err != nil {
+			return err
+		}
+		// kills the cursor on the server if the export stops before reading everything
+		defer mongoSource.Stop()
+		mongoSource = optimus.Transform(mongoSource, transforms.Each(func(d optimus.Row) error {
+			if rows := atomic.AddInt64(&totalMongoRows, 1); rows%1000000 == 0 {
+				log.InfoD("processing-mongo-row", logger.M{"numRows": rows})
+			}
+			return nil
+		}))
+
+		segments := &segmenter{source: mongoSource, size: checkpointRows, lastID: lastID}
+		for segment := len(p.Segments); !segments.done; segment++ {
+			outputName := formatFilename(timestamp, table.Destination, segmentIndex(index, segment), dataFileExtension(table.Meta.Format))
+			staged := stageFile(table.Destination, cp.RunID, outputName)
+			log.InfoD("outputting-file", logger.M{"file-number": index, "segment": segment, "location": outputName})
+			rows, size, err := exportSegment(ctx, segments, targetFileSize, table, output, staged.Staged, timestamp, stats)
+			if err != nil {
+				return err
+			}
+			// need to do this atomically to avoid concurrency issues
+			atomic.AddInt64(&totalSummedRows, rows)
+			if rows == 0 && segment > 0 {
+				// the last segment ended exactly at the end of the partition
+				if err := output.Delete(staged.Staged); err != nil {
+					log.ErrorD("staging-cleanup-error", logger.M{"key": staged.Staged, "error": err.Error()})
+				}
+				return cp.update(func() { p.Done = true })
+			}
+			log.InfoD("output-destination", logger.M{"collection": table.Destination, "count": rows, "fileIndex": index, "segment": segment})
+
+			var last *typedValue
+			if v, err := encodeValue(segments.lastID); err == nil && !segments.mixed {
+				last = &v
+			}
+			finished := segmentCheckpoint{Staged: staged.Staged, Final: staged.Final, Rows: rows, Bytes: size}
+			err = cp.update(func() {
+				p.Segments = append(p.Segments, finished)
+				p.LastID = last
+				p.Done = segments.done
+			})
+			if err != nil {
+				return fmt.Errorf("failed to save checkpoint: %s", err)
+			}
+		}
+		return nil
+	}
+
+	exportErrs := make([]error, len(ranges))
+	var waitGroup sync.WaitGroup
+	for i, r := range ranges {
+		if cp.Partitions[i].Done {
+			log.InfoD("partition-already-exported", logger.M{"partition": i, "segments": len(cp.Partitions[i].Segments)})
+			continue
+		}
+		waitGroup.Add(1)
+		go func(index int, r idRange) {
+			defer waitGroup.Done()
+			exportErrs[index] = exportPartition(index, r)
+		}(i, r)
+	}
+	waitGroup.Wait()
+	if err := ctx.Err(); err != nil {
+		log.WarnD("export-cancelled", logger.M{
+			"collection": table.Destination, "rows-read": atomic.LoadInt64(&totalMongoRows),
+			"rows-written": atomic.LoadInt64(&totalSummedRows), "error": err.Error(),
+		})
+		return err
+	}
+	for i, err := range exportErrs {
+		if err != nil {
+			return fmt.Errorf("failed to export file %d: %s", i, err)
+		}
+	}
+	for column, count := range stats.coercionFailures.snapshot() {
+		log.WarnD("type-coercion-errors", logger.M{"collection": table.Destination, "column": column, "rows": count})
+	}
+	lengthViolations := stats.lengthViolations.snapshot()
+	for column, count := range lengthViolations {
+		log.WarnD("length-limit-violations", logger.M{"collection": table.Destination, "column": column, "rows": count})
+	}
+	if totalSummedRows != totalMongoRows {
+		return fmt.Errorf("rows written (%d) don't match rows read (%d)", totalSummedRows, totalMongoRows)
+	}
+
+	// the checkpoint has every file, including those written by the runs being resumed
+	stagedFiles := []stagedFile{}
+	var rowsWritten int64
+	for _, f := range cp.files() {
+		stagedFiles = append(stagedFiles, stagedFile{Staged: f.Staged, Final: f.Final})
+		report.Files = append(report.Files, fileReport{Name: f.Final, Rows: f.Rows, Bytes: f.Bytes})
+		rowsWritten += f.Rows
+	}
+	log.InfoD("output-total", logger.M{"rows": rowsWritten, "files": len(stagedFiles)})
+	if err := publishFiles(ctx, output, stagedFiles); err != nil {
+		return err
+	}
+	if err := recordStoredSizes(output, report.Files); err != nil {
+		return err
+	}
+
+	// rows read and written have been checked to match, and earlier runs checked their own
+	report.RowsRead = rowsWritten - totalSummedRows + totalMongoRows
+	report.RowsWritten = rowsWritten
+	report.CoercionErrors = stats.coercionFailures.snapshot()
+	report.LengthViolations = lengthViolations
+	return nil
+}
+
+// exportSegment streams the next segment of rows into a data file at key, returning the rows
+// and bytes written. If targetSize is set the segment ends once the file is that big.
+func exportSegment(ctx context.Context, segments *segmenter, targetSize int64, table config.Table, output store.ObjectStore,
+	key, timestamp string, stats *exportStats) (int64, int64, error) {
+	type written struct {
+		rows  int64
+		bytes int64
+		err   error
+	}
+	exported := make(chan written, 1)
+
+	// Stream output into pipe so that we don't need to store locally
+	reader, writer := io.Pipe()
+	counter := &countingWriter{w: writer}
+	var full func() bool
+	if targetSize > 0 {
+		// the sink buffers, so files come out a little bigger than the target
+		full = func() bool { return counter.bytesWritten() >= targetSize }
+	}
+	source := segments.next(full)
+	go func() {
+		sink, flush, err := newDataSink(counter, table, targetSize)
+		if err != nil {
+			err = fmt.Errorf("data sink error: %s", err)
+			// nothing is going to read the segment, so let go of the source
+			source.Stop()
+			writer.CloseWithError(err)
+			exported <- written{err: err}
+			return
+		}
+		count, err := exportData(ctx, source, table, sink, timestamp, stats)
+		if err == nil {
+			// ALWAYS flush the sink (e.g. close the gzip) before closing the pipe
+			err = flush()
+		}
+		if err != nil {
+			err = fmt.Errorf("table read error: %s", err)
+			source.Stop()
+			writer.CloseWithError(err)
+			exported <- written{err: err}
+			return
+		}
+		writer.Close()
+		exported <- written{rows: int64(count), bytes: counter.bytesWritten()}
+	}()
+
+	log.InfoD("uploading-file", logger.M{"filename": key, "path": output.URL(key)})
+	uploadErr := output.Put(ctx, key, reader)
+	if uploadErr != nil {
+		// stop the export feeding the pipe if the upload gave up early
+		reader.CloseWithError(uploadErr)
+	}
+	result := <-exported
+	if result.err != nil {
+		return 0, 0, result.err
+	}
+	if uploadErr != nil {
+		return 0, 0, uploadErr
+	}
+	return result.rows, result.bytes, nil
+}
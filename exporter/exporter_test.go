@@ -0,0 +1,845 @@
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/store"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/Clever/optimus.v3"
+	"gopkg.in/Clever/optimus.v3/sources/slice"
+)
+
+func TestCreateManifest(t *testing.T) {
+	output, err := store.New("s3://bucket")
+	assert.NoError(t, err)
+	reader, err := createManifest(output, []fileReport{{Name: "foo", Rows: 10, Bytes: 1024}, {Name: "bar"}})
+	assert.NoError(t, err)
+	expectedManifest := &Manifest{
+		EntryArray{
+			map[string]interface{}{"url": "s3://bucket/foo", "mandatory": true,
+				"meta": map[string]interface{}{"content_length": float64(1024), "record_count": float64(10)}},
+			map[string]interface{}{"url": "s3://bucket/bar", "mandatory": true,
+				"meta": map[string]interface{}{"content_length": float64(0), "record_count": float64(0)}},
+		},
+	}
+
+	bytes, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	manifest := &Manifest{}
+	err = json.Unmarshal(bytes, manifest)
+	assert.NoError(t, err)
+	// check that the manifest entries match
+	assert.Equal(t, expectedManifest.Entries, manifest.Entries)
+}
+
+func TestEncryptedManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exporter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	plain, err := store.New("file://" + dir)
+	assert.NoError(t, err)
+	output, err := store.WithEncryption(plain, store.Encryption{ClientKey: bytes.Repeat([]byte{1}, 32)})
+	assert.NoError(t, err)
+	conf, err := config.ParseYAML([]byte(testConfig))
+	assert.NoError(t, err)
+
+	segments := &segmenter{source: slice.New([]optimus.Row{{"_id": "a"}, {"_id": "b"}})}
+	rows, written, err := exportSegment(context.Background(), segments, 0, conf["students"], output, "staged.json.gz", "2020-01-02T03:00:00Z", newExportStats())
+	assert.NoError(t, err)
+	assert.NoError(t, publishFiles(context.Background(), output, []stagedFile{{Staged: "staged.json.gz", Final: "final.json.gz"}}))
+
+	// the manifest has the size of the encrypted file, which is padded to a whole block
+	files := []fileReport{{Name: "final.json.gz", Rows: rows, Bytes: written}}
+	assert.NoError(t, recordStoredSizes(output, files))
+	info, err := os.Stat(filepath.Join(dir, "final.json.gz"))
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), files[0].Bytes)
+	assert.Equal(t, written+16-written%16, files[0].Bytes)
+
+	reader, err := createManifest(output, files)
+	assert.NoError(t, err)
+	manifest := &Manifest{}
+	assert.NoError(t, json.NewDecoder(reader).Decode(manifest))
+	assert.Equal(t, float64(info.Size()), manifest.Entries[0]["meta"].(map[string]interface{})["content_length"])
+
+	assert.Error(t, recordStoredSizes(output, []fileReport{{Name: "missing.json.gz"}}))
+}
+
+func TestUploadJSONPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonpaths-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output, err := store.New("file://" + dir)
+	assert.NoError(t, err)
+	conf, err := config.ParseYAML([]byte(testConfig))
+	assert.NoError(t, err)
+
+	url, err := uploadJSONPaths(context.Background(), output, "2020-01-02T03:00:00Z", conf["students"])
+	assert.NoError(t, err)
+	name := formatFilename("2020-01-02T03:00:00Z", "students", "", ".jsonpaths")
+	assert.Equal(t, output.URL(name), url)
+	data, err := output.Get(name)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonpaths": ["$['_data_timestamp']", "$['id']"]}`, string(data))
+}
+
+func TestWatermarkValueRoundTrip(t *testing.T) {
+	now := time.Date(2016, 1, 27, 21, 0, 0, 123, time.UTC)
+	for _, val := range []interface{}{
+		primitive.NewObjectID(),
+		now,
+		int64(42),
+		1.5,
+		"abc",
+	} {
+		encoded, err := encodeValue(val)
+		assert.NoError(t, err)
+		decoded, err := decodeValue(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, val, decoded)
+	}
+
+	_, err := encodeValue([]string{"nope"})
+	assert.Error(t, err)
+}
+
+func TestIncrementalQuery(t *testing.T) {
+	query, incremental, err := incrementalQuery("updatedAt", nil)
+	assert.NoError(t, err)
+	assert.False(t, incremental)
+	assert.Equal(t, bson.M{}, query)
+
+	// a watermark for a different field can't be trusted, so do a full export
+	previous := &watermark{Field: "_id", Value: typedValue{Type: "int", Value: "10"}}
+	query, incremental, err = incrementalQuery("updatedAt", previous)
+	assert.NoError(t, err)
+	assert.False(t, incremental)
+	assert.Equal(t, bson.M{}, query)
+
+	previous.Field = "updatedAt"
+	query, incremental, err = incrementalQuery("updatedAt", previous)
+	assert.NoError(t, err)
+	assert.True(t, incremental)
+	assert.Equal(t, bson.M{"updatedAt": bson.M{"$gt": int64(10)}}, query)
+}
+
+func TestLookupPath(t *testing.T) {
+	doc := bson.M{"a": bson.M{"b": map[string]interface{}{"c": 1}}, "d": 2}
+	val, ok := lookupPath(doc, "a.b.c")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+	val, ok = lookupPath(doc, "d")
+	assert.True(t, ok)
+	assert.Equal(t, 2, val)
+	_, ok = lookupPath(doc, "d.e")
+	assert.False(t, ok)
+}
+
+func TestIDRangeQuery(t *testing.T) {
+	base := bson.M{"updatedAt": bson.M{"$gt": 1}}
+	assert.Equal(t, base, idRange{}.query(base))
+	assert.Equal(t, bson.M{"_id": bson.M{"$gte": 5}}, idRange{Min: 5}.query(bson.M{}))
+	assert.Equal(t, bson.M{"_id": bson.M{"$not": bson.M{"$gte": 5}}}, idRange{Max: 5}.query(bson.M{}))
+	assert.Equal(t, bson.M{"$and": []bson.M{base, {"_id": bson.M{"$gte": 1, "$lt": 5}}}},
+		idRange{Min: 1, Max: 5}.query(base))
+}
+
+func TestPickBoundaries(t *testing.T) {
+	ids := []interface{}{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.Equal(t, []interface{}{3, 5, 7}, pickBoundaries(ids, 4))
+	// duplicates from the sample are skipped
+	assert.Equal(t, []interface{}{1, 2}, pickBoundaries([]interface{}{1, 1, 1, 1, 2, 2}, 4))
+	// not enough samples for the number of partitions
+	assert.Equal(t, []interface{}{}, pickBoundaries([]interface{}{}, 4))
+	assert.Equal(t, []interface{}{}, pickBoundaries(ids, 1))
+}
+
+func TestSameTypeClass(t *testing.T) {
+	assert.True(t, sameTypeClass([]interface{}{1, int64(2), 3.5}))
+	assert.True(t, sameTypeClass([]interface{}{primitive.NewObjectID(), primitive.NewObjectID()}))
+	assert.False(t, sameTypeClass([]interface{}{primitive.NewObjectID(), "abc"}))
+	assert.False(t, sameTypeClass([]interface{}{bson.M{"a": 1}}))
+}
+
+func TestSamplePipeline(t *testing.T) {
+	assert.Equal(t, []bson.M{
+		{"$sample": bson.M{"size": 200}},
+		{"$project": bson.M{"_id": 1}},
+		{"$sort": bson.M{"_id": 1}},
+	}, samplePipeline(bson.M{}, 200))
+	// with a $match, $sample only has to hold the _ids
+	query := bson.M{"updatedAt": bson.M{"$gt": 1}}
+	assert.Equal(t, []bson.M{
+		{"$match": query},
+		{"$project": bson.M{"_id": 1}},
+		{"$sample": bson.M{"size": 200}},
+		{"$sort": bson.M{"_id": 1}},
+	}, samplePipeline(query, 200))
+}
+
+func TestPartitionSamples(t *testing.T) {
+	table := config.Table{Source: "students"}
+	samples := []bson.M{{"_id": int32(1)}, {"_id": int32(2)}, {"_id": int32(3)}, {"_id": int32(4)}}
+	assert.Equal(t, []idRange{{Max: 2}, {Min: 2, Max: 3}, {Min: 3, Max: 4}, {Min: 4}}, partitionSamples(table, samples, 4))
+	assert.Equal(t, []idRange{{}}, partitionSamples(table, []bson.M{{"_id": 1}, {"_id": "a"}}, 2))
+	assert.Equal(t, []idRange{{}}, partitionSamples(table, []bson.M{}, 2))
+}
+
+func TestPartitionCollectionFallback(t *testing.T) {
+	// nothing listens here, so the sample fails and we export a single range instead
+	client, err := mongo.Connect(context.Background(),
+		options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(100*time.Millisecond))
+	assert.NoError(t, err)
+	defer client.Disconnect(context.Background())
+	table := config.Table{Source: "students"}
+
+	ranges, err := partitionCollection(context.Background(), client.Database("test"), table, bson.M{}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []idRange{{}}, ranges)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = partitionCollection(ctx, client.Database("test"), table, bson.M{}, 4)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestParquetSchema(t *testing.T) {
+	table := config.Table{Fields: []config.Field{
+		{Destination: "_data_timestamp", Type: config.TypeTimestamp},
+		{Destination: "id", Source: "_id", Type: config.TypeText},
+		{Destination: "count", Source: "count", Type: config.TypeInt},
+		{Destination: "untyped", Source: "untyped"},
+	}}
+	expected := `{"Tag": "name=parquet_go_root, repetitiontype=REQUIRED", "Fields": [` +
+		`{"Tag": "name=_data_timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"}, ` +
+		`{"Tag": "name=id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"}, ` +
+		`{"Tag": "name=count, type=INT32, repetitiontype=OPTIONAL"}, ` +
+		`{"Tag": "name=untyped, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"}]}`
+	assert.Equal(t, expected, parquetSchema(table))
+	assert.Equal(t, ".parquet", dataFileExtension(config.FormatParquet))
+	assert.Equal(t, ".json.gz", dataFileExtension(""))
+}
+
+func TestParquetValue(t *testing.T) {
+	val, err := parquetValue(config.TypeTimestamp, "2016-01-27T21:00:00.5Z")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1453928400500), val)
+
+	val, err = parquetValue(config.TypeBigInt, int64(5))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), val)
+
+	val, err = parquetValue("", map[string]interface{}{"a": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, val)
+
+	val, err = parquetValue(config.TypeText, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+}
+
+func TestParquetTargetFileSize(t *testing.T) {
+	assert.Equal(t, int64(0), parquetRowGroupSize(0))
+	assert.Equal(t, int64(minParquetRowGroupSize), parquetRowGroupSize(1))
+	assert.Equal(t, int64(64<<20), parquetRowGroupSize(64<<20))
+
+	dir, err := ioutil.TempDir("", "parquet-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output, err := store.New("file://" + dir)
+	assert.NoError(t, err)
+	conf, err := config.ParseYAML([]byte(testConfig))
+	assert.NoError(t, err)
+	table := conf["students"]
+	table.Meta.Format = config.FormatParquet
+
+	// random ids so the files don't compress below the target
+	random := rand.New(rand.NewSource(1))
+	rows := []optimus.Row{}
+	for i := 0; i < 20000; i++ {
+		id := make([]byte, 64)
+		random.Read(id)
+		rows = append(rows, optimus.Row{"_id": fmt.Sprintf("%x", id)})
+	}
+
+	segments := &segmenter{source: slice.New(rows)}
+	files, total := 0, int64(0)
+	for !segments.done {
+		key := fmt.Sprintf("students_%d.parquet", files)
+		count, size, err := exportSegment(context.Background(), segments, minParquetRowGroupSize, table, output, key,
+			"2020-01-02T03:00:00Z", newExportStats())
+		assert.NoError(t, err)
+		if count > 0 {
+			assert.True(t, size >= minParquetRowGroupSize || segments.done, "file %d is only %d bytes", files, size)
+			files++
+			total += count
+		}
+	}
+	assert.True(t, files > 1, "expected more than one file, got %d", files)
+	assert.Equal(t, int64(len(rows)), total)
+}
+
+func TestRunReport(t *testing.T) {
+	report := &runReport{
+		Version:          "abc123",
+		Config:           "sis",
+		Collection:       "students",
+		DebounceDecision: debounceStale,
+		RowsRead:         3,
+		RowsWritten:      3,
+		Files:            []fileReport{{Name: "foo", Rows: 3, Bytes: 100}},
+	}
+	reader, err := report.reader()
+	assert.NoError(t, err)
+	assert.False(t, report.EndTime.IsZero())
+
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	decoded := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "stale", decoded["debounce_decision"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"name": "foo", "rows": 3.0, "bytes": 100.0}}, decoded["files"])
+}
+
+func TestCountingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &countingWriter{w: &buf}
+	w.Write([]byte("hello"))
+	w.Write([]byte(" world"))
+	assert.Equal(t, int64(11), w.bytesWritten())
+	assert.Equal(t, "hello world", buf.String())
+}
+
+func TestResolveEncryption(t *testing.T) {
+	mode, enc, err := resolveEncryption(config.Encryption{}, EncryptionOverrides{})
+	assert.NoError(t, err)
+	assert.Equal(t, config.EncryptionSSES3, mode)
+	assert.Equal(t, store.Encryption{}, enc)
+	_, enc, err = resolveEncryption(config.Encryption{Mode: config.EncryptionSSES3}, EncryptionOverrides{})
+	assert.NoError(t, err)
+	assert.Equal(t, store.Encryption{SSE: store.SSEAES256}, enc)
+
+	conf := config.Encryption{Mode: config.EncryptionSSEKMS, KMSKeyID: "alias/config", KMSContext: map[string]string{"a": "b"}}
+	mode, enc, err = resolveEncryption(conf, EncryptionOverrides{})
+	assert.NoError(t, err)
+	assert.Equal(t, config.EncryptionSSEKMS, mode)
+	assert.Equal(t, store.Encryption{SSE: store.SSEKMS, KMSKeyID: "alias/config", KMSContext: map[string]string{"a": "b"}}, enc)
+
+	// flags win over the config
+	_, enc, err = resolveEncryption(conf, EncryptionOverrides{KMSKeyID: "alias/flag", KMSContext: `{"c":"d"}`})
+	assert.NoError(t, err)
+	assert.Equal(t, store.Encryption{SSE: store.SSEKMS, KMSKeyID: "alias/flag", KMSContext: map[string]string{"c": "d"}}, enc)
+
+	mode, enc, err = resolveEncryption(conf, EncryptionOverrides{Mode: config.EncryptionNone})
+	assert.NoError(t, err)
+	assert.Equal(t, config.EncryptionNone, mode)
+	assert.Equal(t, store.Encryption{SSE: store.SSENone}, enc)
+
+	_, _, err = resolveEncryption(conf, EncryptionOverrides{KMSContext: "not json"})
+	assert.Error(t, err)
+	_, _, err = resolveEncryption(config.Encryption{}, EncryptionOverrides{Mode: config.EncryptionClient})
+	assert.Error(t, err)
+	_, _, err = resolveEncryption(config.Encryption{}, EncryptionOverrides{Mode: config.EncryptionClient, KeyFile: "/does/not/exist"})
+	assert.Error(t, err)
+}
+
+func TestStageFile(t *testing.T) {
+	runID := newRunID(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	assert.Regexp(t, `^20200102T030405Z-[0-9a-f]{8}$`, runID)
+
+	final := formatFilename("2020-01-02T03:00:00Z", "students", "0", ".json.gz")
+	staged := stageFile("students", runID, final)
+	assert.Equal(t, final, staged.Final)
+	assert.Equal(t, "mongo_raw/students/_staging/"+runID+"/mongo_raw_students_2020-01-02T03:00:00Z_0.json.gz", staged.Staged)
+}
+
+func TestPublishFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publish-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output, err := store.New("file://" + dir)
+	assert.NoError(t, err)
+
+	staging := stagingPrefix("students", "run")
+	files := []stagedFile{
+		stageFile("students", "run", "mongo_raw/students/a.json.gz"),
+		stageFile("students", "run", "mongo_raw/students/b.json.gz"),
+	}
+	for _, f := range files {
+		assert.NoError(t, output.PutBytes(f.Staged, []byte(f.Final)))
+	}
+	// another run's staged files are left alone
+	assert.NoError(t, output.PutBytes(stagingPrefix("students", "other")+"c.json.gz", []byte("c")))
+
+	assert.NoError(t, publishFiles(context.Background(), output, files))
+	cleanupStaging(output, staging)
+
+	for _, f := range files {
+		data, err := output.Get(f.Final)
+		assert.NoError(t, err)
+		assert.Equal(t, f.Final, string(data))
+	}
+	keys, err := output.List("mongo_raw/students/_staging/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mongo_raw/students/_staging/other/c.json.gz"}, keys)
+
+	assert.Error(t, publishFiles(context.Background(), output, files))
+}
+
+const testConfig = `
+students:
+  dest: students
+  source: students
+  columns:
+  - dest: _data_timestamp
+    type: timestamp
+    sortord: 1
+  - dest: id
+    source: _id
+    type: text
+    primarykey: true
+    notnull: true
+  meta:
+    datadatecolumn: _data_timestamp
+`
+
+func TestRunSkipsFreshTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exporter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output, err := store.New("file://" + dir)
+	assert.NoError(t, err)
+
+	dialed := false
+	e := New(func(ctx context.Context) (*mongo.Database, error) {
+		dialed = true
+		return nil, fmt.Errorf("shouldn't dial")
+	}, "host1:27017", "abc123")
+	result, err := e.Run(context.Background(), Options{
+		ConfigName:   "sis",
+		Config:       testConfig,
+		ConfigSource: "s3://configs/sis.yml",
+		Collection:   "students",
+		Output:       output,
+		Timestamp:    "2020-01-02T03:00:00Z",
+		IsFresh:      func(destination string) bool { return destination == "students" },
+	})
+	assert.NoError(t, err)
+	assert.False(t, dialed)
+	assert.True(t, result.Skipped)
+	assert.Equal(t, "students", result.Destination)
+	assert.Equal(t, output.URL(formatFilename("2020-01-02T03:00:00Z", "sis", "", ".yml")), result.ConfigURL)
+	data, err := output.Get(formatFilename("2020-01-02T03:00:00Z", "sis", "", ".yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# source: s3://configs/sis.yml\n"+testConfig, string(data))
+
+	data, err = output.Get(formatFilename("2020-01-02T03:00:00Z", "students", "", ".report.json"))
+	assert.NoError(t, err)
+	report := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(data, &report))
+	assert.Equal(t, "fresh", report["debounce_decision"])
+	assert.Equal(t, "host1:27017", report["mongo_host"])
+	assert.Equal(t, "abc123", report["version"])
+}
+
+func TestRunClientEncryptionLeavesConfigPlain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exporter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output, err := store.New("file://" + dir)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(dir, "key")
+	assert.NoError(t, ioutil.WriteFile(keyFile, bytes.Repeat([]byte{1}, 32), 0600))
+
+	e := New(func(ctx context.Context) (*mongo.Database, error) { return nil, fmt.Errorf("shouldn't dial") }, "", "")
+	result, err := e.Run(context.Background(), Options{
+		ConfigName: "sis",
+		Config:     testConfig,
+		Collection: "students",
+		Output:     output,
+		Timestamp:  "2020-01-02T03:00:00Z",
+		Encryption: EncryptionOverrides{Mode: config.EncryptionClient, KeyFile: keyFile},
+		IsFresh:    func(string) bool { return true },
+	})
+	assert.NoError(t, err)
+	assert.True(t, result.ClientEncrypted)
+
+	// the load reads the config copy itself, so it's stored as is
+	configFile := filepath.Join(dir, formatFilename("2020-01-02T03:00:00Z", "sis", "", ".yml"))
+	data, err := ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, testConfig, string(data))
+	_, err = os.Stat(filepath.Join(filepath.Dir(configFile), "."+filepath.Base(configFile)+".metadata.json"))
+	assert.True(t, os.IsNotExist(err), "the config copy has encryption metadata")
+}
+
+func TestRunErrors(t *testing.T) {
+	output, err := store.New("file:///does/not/matter")
+	assert.NoError(t, err)
+	e := New(func(ctx context.Context) (*mongo.Database, error) { return nil, fmt.Errorf("shouldn't dial") }, "", "")
+
+	for _, opts := range []Options{
+		{Config: testConfig, Collection: "students"},
+		{Config: testConfig, Collection: "students", Output: output, NumFiles: -1},
+		{Config: testConfig, Collection: "students", Output: output, Timestamp: "yesterday"},
+		{Config: "not: [valid", Collection: "students", Output: output},
+		{Config: testConfig, Collection: "teachers", Output: output},
+		{Config: testConfig, Collection: "students", Output: output, Encryption: EncryptionOverrides{Mode: "rot13"}},
+		{Config: testConfig, Collection: "students", Output: output, CheckpointRows: -1},
+		{Config: testConfig, Collection: "students", Output: output, TargetFileSize: -1},
+		{Config: testConfig, Collection: "students", Output: output, Resume: true},
+	} {
+		_, err := e.Run(context.Background(), opts)
+		assert.Error(t, err)
+	}
+
+	// unknown column types fail before anything is written
+	_, err = e.Run(context.Background(), Options{Config: strings.Replace(testConfig, "type: text", "type: varchar", 1), Collection: "students", Output: output})
+	assert.EqualError(t, err, "column 'id' has unknown type 'varchar'")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = e.Run(ctx, Options{Config: testConfig, Collection: "students", Output: output})
+	assert.Equal(t, context.Canceled, err)
+}
+
+// failingStore fails uploads of staged data files after the first few, like an export
+// that dies partway through
+type failingStore struct {
+	store.ObjectStore
+	uploads int
+}
+
+func (f *failingStore) Put(ctx context.Context, key string, body io.Reader) error {
+	if strings.Contains(key, "/_staging/") {
+		if f.uploads >= 2 {
+			return fmt.Errorf("upload failed")
+		}
+		f.uploads++
+	}
+	return f.ObjectStore.Put(ctx, key, body)
+}
+
+const mongoTestConfig = `
+students:
+  dest: students
+  source: students
+  columns:
+  - dest: _data_timestamp
+    type: timestamp
+  - dest: id
+    source: _id
+    type: text
+    primarykey: true
+  - dest: name
+    source: name
+    type: text
+  meta:
+    datadatecolumn: _data_timestamp
+    incremental_field: _id
+`
+
+// readExport checks the manifest of an export against its data files and returns the
+// names exported, keyed by id
+func readExport(t *testing.T, output store.ObjectStore, dir, timestamp string) map[string]string {
+	data, err := output.Get(formatFilename(timestamp, "students", "", ".manifest"))
+	assert.NoError(t, err)
+	var manifest struct {
+		Entries []struct {
+			URL  string `json:"url"`
+			Meta struct {
+				ContentLength int64 `json:"content_length"`
+				RecordCount   int64 `json:"record_count"`
+			} `json:"meta"`
+		} `json:"entries"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &manifest))
+
+	names := map[string]string{}
+	rows := int64(0)
+	for _, entry := range manifest.Entries {
+		path := strings.TrimPrefix(entry.URL, "file://")
+		assert.True(t, strings.HasPrefix(path, dir), "%s is outside the output", entry.URL)
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, info.Size(), entry.Meta.ContentLength)
+
+		f, err := os.Open(path)
+		assert.NoError(t, err)
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		assert.NoError(t, err)
+		count := int64(0)
+		decoder := json.NewDecoder(gz)
+		for decoder.More() {
+			row := map[string]interface{}{}
+			assert.NoError(t, decoder.Decode(&row))
+			id := fmt.Sprint(row["id"])
+			_, dup := names[id]
+			assert.False(t, dup, "%s was exported twice", id)
+			names[id] = fmt.Sprint(row["name"])
+			count++
+		}
+		assert.Equal(t, count, entry.Meta.RecordCount)
+		rows += count
+	}
+	assert.Equal(t, int64(len(names)), rows)
+	return names
+}
+
+// seedStudents inserts students with ids s<from> up to but not including s<to>
+func seedStudents(t *testing.T, collection *mongo.Collection, from, to int) map[string]string {
+	docs := []interface{}{}
+	names := map[string]string{}
+	for i := from; i < to; i++ {
+		id, name := fmt.Sprintf("s%02d", i), fmt.Sprintf("student %d", i)
+		docs = append(docs, bson.M{"_id": id, "name": name})
+		names[id] = name
+	}
+	_, err := collection.InsertMany(context.Background(), docs)
+	assert.NoError(t, err)
+	return names
+}
+
+// TestRunMongo runs full, incremental and resumed exports against a real mongo, e.g.
+// MONGO_URL=mongodb://localhost:27017/mongo_to_s3_test
+func TestRunMongo(t *testing.T) {
+	mongoURL := os.Getenv("MONGO_URL")
+	if mongoURL == "" {
+		t.Skip("MONGO_URL not set")
+	}
+	dial := func(ctx context.Context) (*mongo.Database, error) {
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
+		if err != nil {
+			return nil, err
+		}
+		return client.Database("mongo_to_s3_test"), nil
+	}
+	db, err := dial(context.Background())
+	assert.NoError(t, err)
+	defer db.Client().Disconnect(context.Background())
+	collection := db.Collection("students")
+	assert.NoError(t, collection.Drop(context.Background()))
+
+	dir, err := ioutil.TempDir("", "exporter-mongo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output, err := store.New("file://" + dir)
+	assert.NoError(t, err)
+	e := New(dial, "localhost", "test")
+	opts := Options{ConfigName: "sis", Config: mongoTestConfig, Collection: "students", Output: output}
+	assertWatermark := func(value string) {
+		w, err := readWatermark(output, "students")
+		assert.NoError(t, err)
+		if assert.NotNil(t, w) {
+			assert.Equal(t, typedValue{Type: "string", Value: value}, w.Value)
+		}
+	}
+
+	// the first run exports everything
+	expected := seedStudents(t, collection, 0, 20)
+	opts.Timestamp, opts.NumFiles = "2020-01-01T00:00:00Z", 2
+	result, err := e.Run(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.False(t, result.Incremental)
+	assert.Equal(t, int64(20), result.RowsWritten)
+	assert.Equal(t, expected, readExport(t, output, dir, opts.Timestamp))
+	assertWatermark("s19")
+
+	// the next only exports what's new
+	expected = seedStudents(t, collection, 20, 25)
+	opts.Timestamp, opts.NumFiles = "2020-01-02T00:00:00Z", 1
+	result, err = e.Run(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.True(t, result.Incremental)
+	assert.Equal(t, int64(5), result.RowsWritten)
+	assert.Equal(t, expected, readExport(t, output, dir, opts.Timestamp))
+	assertWatermark("s24")
+
+	// a run that fails partway through keeps its checkpoint, but nothing is published
+	expected = seedStudents(t, collection, 25, 45)
+	opts.Timestamp, opts.CheckpointRows = "2020-01-03T00:00:00Z", 5
+	failing := opts
+	failing.Output = &failingStore{ObjectStore: output}
+	_, err = e.Run(context.Background(), failing)
+	assert.Error(t, err)
+	_, err = output.Get(formatFilename(opts.Timestamp, "students", "", ".manifest"))
+	assert.Equal(t, store.ErrNotFound, err)
+	_, err = output.Get(checkpointFilename("students"))
+	assert.NoError(t, err)
+	assertWatermark("s24")
+
+	// resuming it exports each new document exactly once, keeping the files already written
+	opts.Resume = true
+	result, err = e.Run(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.True(t, result.Incremental)
+	assert.Equal(t, int64(20), result.RowsWritten)
+	assert.Equal(t, expected, readExport(t, output, dir, opts.Timestamp))
+	assertWatermark("s44")
+	_, err = output.Get(checkpointFilename("students"))
+	assert.Equal(t, store.ErrNotFound, err)
+
+	// with client encryption only the data files are encrypted, since the load has to read
+	// the manifest, jsonpaths and config copy as they are
+	key := bytes.Repeat([]byte{1}, 32)
+	keyFile := filepath.Join(dir, "key")
+	assert.NoError(t, ioutil.WriteFile(keyFile, key, 0600))
+	seedStudents(t, collection, 45, 50)
+	opts = Options{ConfigName: "sis", Config: mongoTestConfig, Collection: "students", Output: output, Timestamp: "2020-01-04T00:00:00Z",
+		Encryption: EncryptionOverrides{Mode: config.EncryptionClient, KeyFile: keyFile}}
+	result, err = e.Run(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.True(t, result.ClientEncrypted)
+	for _, extension := range []string{".manifest", ".jsonpaths"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, formatFilename(opts.Timestamp, "students", "", extension)))
+		assert.NoError(t, err)
+		assert.True(t, json.Valid(data), "%s isn't plain JSON", extension)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, formatFilename(opts.Timestamp, "sis", "", ".yml")))
+	assert.NoError(t, err)
+	assert.Equal(t, mongoTestConfig, string(data))
+
+	dataFile := formatFilename(opts.Timestamp, "students", "0", ".json.gz")
+	raw, err := ioutil.ReadFile(filepath.Join(dir, dataFile))
+	assert.NoError(t, err)
+	_, err = gzip.NewReader(bytes.NewReader(raw))
+	assert.Error(t, err, "the data file isn't encrypted")
+	decrypting, err := store.WithEncryption(output, store.Encryption{ClientKey: key})
+	assert.NoError(t, err)
+	decrypted, err := decrypting.Get(dataFile)
+	assert.NoError(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(decrypted))
+	assert.NoError(t, err)
+	rows, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, strings.Count(string(rows), "\n"))
+}
+
+func TestExportDataCancelled(t *testing.T) {
+	conf, err := config.ParseYAML([]byte(testConfig))
+	assert.NoError(t, err)
+	table := conf["students"]
+	rows := []optimus.Row{{"_id": "a"}, {"_id": "b"}}
+	discard := func(t optimus.Table) error {
+		for range t.Rows() {
+		}
+		return t.Err()
+	}
+
+	count, err := exportData(context.Background(), slice.New(rows), table, discard, "2020-01-02T03:00:00Z", newExportStats())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	count, err = exportData(ctx, slice.New(rows), table, discard, "2020-01-02T03:00:00Z", newExportStats())
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output, err := store.New("file://" + dir)
+	assert.NoError(t, err)
+
+	missing, err := readCheckpoint(output, "students")
+	assert.NoError(t, err)
+	assert.Nil(t, missing)
+
+	id, err := primitive.ObjectIDFromHex("5e0000000000000000000000")
+	assert.NoError(t, err)
+	ranges := []idRange{{Max: id}, {Min: id}}
+	cp := newCheckpoint("run", "2020-01-02T03:00:00Z", "students")
+	assert.NoError(t, cp.setRanges(ranges))
+	cp.output = output
+	segment := segmentCheckpoint{Staged: "staged", Final: "final", Rows: 10, Bytes: 100}
+	assert.NoError(t, cp.update(func() {
+		cp.Partitions[1].Segments = append(cp.Partitions[1].Segments, segment)
+		cp.Partitions[1].LastID = &typedValue{Type: "int", Value: "7"}
+	}))
+
+	saved, err := readCheckpoint(output, "students")
+	assert.NoError(t, err)
+	assert.Equal(t, "run", saved.RunID)
+	assert.Equal(t, "2020-01-02T03:00:00Z", saved.Timestamp)
+	assert.Equal(t, []segmentCheckpoint{segment}, saved.files())
+	assert.Equal(t, typedValue{Type: "int", Value: "7"}, *saved.Partitions[1].LastID)
+	savedRanges, err := saved.ranges()
+	assert.NoError(t, err)
+	assert.Equal(t, ranges, savedRanges)
+
+	assert.NoError(t, output.PutBytes(stagingPrefix("students", "run")+"staged", []byte("data")))
+	discardCheckpoint(output, saved)
+	keys, err := output.List("mongo_raw/students/")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	assert.Error(t, newCheckpoint("run", "", "students").setRanges([]idRange{{Min: bson.M{"a": 1}}}))
+}
+
+func TestSegmentIndex(t *testing.T) {
+	assert.Equal(t, "0", segmentIndex(0, 0))
+	assert.Equal(t, "3", segmentIndex(3, 0))
+	assert.Equal(t, "3_2", segmentIndex(3, 2))
+}
+
+func TestSegmenter(t *testing.T) {
+	rows := []optimus.Row{{"_id": 1}, {"_id": 2}, {"_id": 3}, {"_id": 4}, {"_id": 5}}
+	read := func(table optimus.Table) []interface{} {
+		ids := []interface{}{}
+		for row := range table.Rows() {
+			ids = append(ids, row["_id"])
+		}
+		assert.NoError(t, table.Err())
+		return ids
+	}
+
+	s := &segmenter{source: slice.New(rows), size: 2}
+	assert.Equal(t, []interface{}{1, 2}, read(s.next(nil)))
+	assert.Equal(t, 2, s.lastID)
+	assert.False(t, s.done)
+	assert.Equal(t, []interface{}{3, 4}, read(s.next(nil)))
+	assert.Equal(t, []interface{}{5}, read(s.next(nil)))
+	assert.True(t, s.done)
+	assert.False(t, s.mixed)
+
+	// without a size everything is in one segment
+	s = &segmenter{source: slice.New(rows)}
+	assert.Len(t, read(s.next(nil)), 5)
+	assert.True(t, s.done)
+
+	// segments also end when they're full, but never before their first row
+	s = &segmenter{source: slice.New(rows), size: 3}
+	full := func() bool { return true }
+	assert.Equal(t, []interface{}{1}, read(s.next(full)))
+	assert.Equal(t, []interface{}{2, 3, 4}, read(s.next(nil)))
+	assert.Equal(t, []interface{}{5}, read(s.next(full)))
+	assert.False(t, s.done)
+	assert.Empty(t, read(s.next(full)))
+	assert.True(t, s.done)
+
+	// a resumed segmenter carries on from the checkpoint's _id
+	s = &segmenter{source: slice.New([]optimus.Row{{"_id": "a"}}), lastID: 5}
+	read(s.next(nil))
+	assert.True(t, s.mixed)
+}
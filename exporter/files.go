@@ -0,0 +1,134 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/store"
+	json "github.com/pquerna/ffjson/ffjson"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// copyConfigFile writes the config next to the data files for the load, and returns its URL.
+// If source is set it's noted in a comment at the top.
+func copyConfigFile(output store.ObjectStore, timestamp, data, configName, source string) (string, error) {
+	// config_name is parsed from the input path b/c we have a different configs`
+	// get the yaml file at the end of the path
+	outName := formatFilename(timestamp, configName, "", ".yml")
+	log.InfoD("conf-file-upload", logger.M{"path": output.URL(outName), "source": source})
+	if source != "" {
+		data = fmt.Sprintf("# source: %s\n%s", source, data)
+	}
+	if err := output.PutBytes(outName, []byte(data)); err != nil {
+		return "", fmt.Errorf("failed to write config file: %s", err)
+	}
+	return output.URL(outName), nil
+}
+
+// uploadFile streams a file to the output store
+// it takes in a reader for maximum flexibility
+func uploadFile(ctx context.Context, reader io.Reader, output store.ObjectStore, outputName string) error {
+	log.InfoD("uploading-file", logger.M{"filename": outputName, "path": output.URL(outputName)})
+	if err := output.Put(ctx, outputName, reader); err != nil {
+		return fmt.Errorf("failed to upload %s: %s", output.URL(outputName), err)
+	}
+	return nil
+}
+
+// uploadReport finishes the run report and uploads it
+func uploadReport(ctx context.Context, report *runReport, output store.ObjectStore, outputName string) error {
+	reader, err := report.reader()
+	if err != nil {
+		return fmt.Errorf("failed to create report: %s", err)
+	}
+	return uploadFile(ctx, reader, output, outputName)
+}
+
+// uploadJSONPaths writes the JSONPaths file for loading the table's JSON data files next to
+// the manifest, and returns its URL
+func uploadJSONPaths(ctx context.Context, output store.ObjectStore, timestamp string, table config.Table) (string, error) {
+	data, err := json.Marshal(table.JSONPaths())
+	if err != nil {
+		return "", fmt.Errorf("failed to create jsonpaths: %s", err)
+	}
+	outName := formatFilename(timestamp, table.Destination, "", ".jsonpaths")
+	if err := uploadFile(ctx, bytes.NewReader(data), output, outName); err != nil {
+		return "", err
+	}
+	return output.URL(outName), nil
+}
+
+// uploadDriftReport writes a report of differences between the exported documents and
+// the table's columns next to the manifest
+func uploadDriftReport(ctx context.Context, output store.ObjectStore, timestamp string, table config.Table, tally *config.SchemaTally) error {
+	report := config.NewDriftReport(table, tally)
+	log.InfoD("schema-drift", logger.M{
+		"collection": table.Destination, "drift": report.HasDrift(),
+		"new-paths": len(report.NewPaths), "missing-paths": len(report.MissingPaths),
+	})
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to create drift report: %s", err)
+	}
+	return uploadFile(ctx, bytes.NewReader(data), output, formatFilename(timestamp, table.Destination, "", ".drift.json"))
+}
+
+// EntryArray is a convenience function for JSON marshalling
+type EntryArray []map[string]interface{}
+
+// Manifest represents an s3 manifest file used to download to redshift
+// really only useful for JSON marshalling
+type Manifest struct {
+	Entries EntryArray `json:"entries"`
+}
+
+// createManifest creates a manifest file given the list of files to include into the file
+// it returns a reader for convenience
+// looks something like:
+//
+//	{ "entries": [
+//	  {"url": "s3://clever-analytics/mongo_students_1_2016-01-27T21:00:00Z.json.gz", "mandatory": true,
+//	   "meta": {"content_length": 1024, "record_count": 10}},
+//	  {"url": "s3://clever-analytics/mongo_students_2_2016-01-27T21:00:00Z.json.gz", "mandatory": true,
+//	   "meta": {"content_length": 2048, "record_count": 20}}
+//	] }
+//
+// content_length is the stored size Redshift checks the file against, and is required
+// when loading parquet from a manifest
+func createManifest(output store.ObjectStore, files []fileReport) (io.Reader, error) {
+	var entryArray EntryArray
+	for _, f := range files {
+		entryArray = append(entryArray, map[string]interface{}{
+			"url":       output.URL(f.Name),
+			"mandatory": true,
+			"meta": map[string]interface{}{
+				"content_length": f.Bytes,
+				"record_count":   f.Rows,
+			},
+		})
+	}
+
+	jsonVal, err := json.Marshal(Manifest{Entries: entryArray})
+	if err != nil {
+		return nil, err
+	}
+	log.InfoD("manifest-file-contents", logger.M{"value": string(jsonVal)})
+	return bytes.NewReader(jsonVal), nil
+}
+
+// recordStoredSizes sets each file's bytes to the size of its stored object, which is
+// what the manifest's content_length is checked against. It's more than was written
+// when the files are client encrypted.
+func recordStoredSizes(output store.ObjectStore, files []fileReport) error {
+	for i, f := range files {
+		size, err := output.Size(f.Name)
+		if err != nil {
+			return fmt.Errorf("failed to look up the size of %s: %s", output.URL(f.Name), err)
+		}
+		files[i].Bytes = size
+	}
+	return nil
+}
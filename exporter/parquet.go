@@ -0,0 +1,138 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	json "github.com/pquerna/ffjson/ffjson"
+	"github.com/xitongsys/parquet-go-source/writerfile"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// parquetWriterParallelism is the number of goroutines the parquet writer uses to encode pages
+const parquetWriterParallelism = 4
+
+// minParquetRowGroupSize is the smallest row group we write, however small the target file
+// size is, since tiny row groups make files slow to read
+const minParquetRowGroupSize = 1 << 20
+
+// parquetTypes maps config column types to parquet-go schema tag types. Anything
+// else, including columns without a type, is stored as a string.
+var parquetTypes = map[string]string{
+	config.TypeBoolean:   "type=BOOLEAN",
+	config.TypeInt:       "type=INT32",
+	config.TypeBigInt:    "type=INT64",
+	config.TypeFloat:     "type=DOUBLE",
+	config.TypeTimestamp: "type=INT64, convertedtype=TIMESTAMP_MILLIS",
+}
+
+// parquetSchema builds the JSON schema definition parquet-go expects from the table's columns.
+// Every column is optional since mongo documents don't have to contain every field.
+func parquetSchema(table config.Table) string {
+	types := table.ColumnTypes()
+	fields := []string{}
+	for _, column := range table.Destinations() {
+		parquetType, ok := parquetTypes[types[column]]
+		if !ok {
+			parquetType = "type=BYTE_ARRAY, convertedtype=UTF8"
+		}
+		tag := fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", column, parquetType)
+		fields = append(fields, fmt.Sprintf(`{"Tag": %q}`, tag))
+	}
+	return fmt.Sprintf(`{"Tag": "name=parquet_go_root, repetitiontype=REQUIRED", "Fields": [%s]}`,
+		strings.Join(fields, ", "))
+}
+
+// parquetValue converts a row value into what's stored in a parquet column of the given type.
+// Values have already been coerced to the column type by this point.
+func parquetValue(columnType string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch columnType {
+	case config.TypeBoolean, config.TypeInt, config.TypeBigInt, config.TypeFloat:
+		return v, nil
+	case config.TypeTimestamp:
+		t, err := time.Parse(config.TimestampFormat, fmt.Sprint(v))
+		if err != nil {
+			return nil, err
+		}
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case primitive.ObjectID:
+		return val.Hex(), nil
+	case time.Time:
+		return val.UTC().Format(config.TimestampFormat), nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+// parquetRowGroupSize is how big row groups get for the given target file size. Nothing is
+// written out until a row group is done, so they can't be bigger than the target if files
+// are going to roll over at it. 0 leaves parquet-go's default.
+func parquetRowGroupSize(targetSize int64) int64 {
+	if targetSize <= 0 {
+		return 0
+	}
+	if targetSize < minParquetRowGroupSize {
+		return minParquetRowGroupSize
+	}
+	return targetSize
+}
+
+// parquetSink writes rows as a snappy compressed parquet file with one column per
+// destination in the table config. Values for unknown columns are dropped. Rows are
+// written out in row groups of rowGroupSize compressed bytes, or parquet-go's default if 0.
+func parquetSink(out io.Writer, table config.Table, rowGroupSize int64) optimus.Sink {
+	return func(source optimus.Table) error {
+		defer source.Stop()
+		pw, err := writer.NewJSONWriter(parquetSchema(table), writerfile.NewWriterFile(out), parquetWriterParallelism)
+		if err != nil {
+			return err
+		}
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+		if rowGroupSize > 0 {
+			pw.RowGroupSize = rowGroupSize
+		}
+
+		columns := table.Destinations()
+		types := table.ColumnTypes()
+		for row := range source.Rows() {
+			record := map[string]interface{}{}
+			for _, column := range columns {
+				val, err := parquetValue(types[column], row[column])
+				if err != nil {
+					return err
+				}
+				if val != nil {
+					record[column] = val
+				}
+			}
+			encoded, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := pw.Write(string(encoded)); err != nil {
+				return err
+			}
+		}
+		if err := source.Err(); err != nil {
+			return err
+		}
+		return pw.WriteStop()
+	}
+}
@@ -0,0 +1,156 @@
+package exporter
+
+import (
+	"context"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/mongosource"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// samplesPerPartition is how many random _ids we look at per partition when picking
+// boundaries. More samples give more evenly sized partitions.
+const samplesPerPartition = 100
+
+// idRange is a range of _id values that gets its own cursor and output file.
+// Min is inclusive and Max is exclusive. A nil bound means the range is unbounded on that side.
+type idRange struct {
+	Min interface{}
+	Max interface{}
+}
+
+// query restricts the given query to the _ids in the range
+func (r idRange) query(base bson.M) bson.M {
+	var cond bson.M
+	switch {
+	case r.Min == nil && r.Max == nil:
+		return base
+	case r.Min == nil:
+		// mongo only compares values of the same BSON type, so a plain $lt would skip any
+		// _ids of a different type than our boundaries. The first range picks those up.
+		cond = bson.M{"$not": bson.M{"$gte": r.Max}}
+	case r.Max == nil:
+		cond = bson.M{"$gte": r.Min}
+	default:
+		cond = bson.M{"$gte": r.Min, "$lt": r.Max}
+	}
+
+	idQuery := bson.M{"_id": cond}
+	if len(base) == 0 {
+		return idQuery
+	}
+	return bson.M{"$and": []bson.M{base, idQuery}}
+}
+
+// partitionCollection splits the documents matching the query into at most n _id ranges of
+// roughly equal size, using boundaries from a random sample of the collection. It falls back
+// to fewer ranges if the sample is too small or the _ids aren't comparable, and to a single
+// range if the sample can't be taken at all.
+func partitionCollection(ctx context.Context, db *mongo.Database, table config.Table, query bson.M, n int) ([]idRange, error) {
+	if n <= 1 {
+		return []idRange{{}}, nil
+	}
+
+	// sampling is only an optimization, so don't fail the run if it doesn't work out
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	cursor, err := db.Collection(table.Source).Aggregate(ctx, samplePipeline(query, n*samplesPerPartition), opts)
+	if err == nil {
+		var samples []bson.M
+		if err = cursor.All(ctx, &samples); err == nil {
+			return partitionSamples(table, samples, n), nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	log.WarnD("partition-sample-failed", logger.M{"collection": table.Source, "error": err.Error()})
+	return []idRange{{}}, nil
+}
+
+// samplePipeline builds the aggregation returning a sorted random sample of _ids matching the query
+func samplePipeline(query bson.M, size int) []bson.M {
+	// $sample is only fast as the first stage, so avoid the $match unless we need it. When we
+	// do need it, drop everything but the _id first so $sample has less to hold in memory.
+	pipeline := []bson.M{}
+	if len(query) > 0 {
+		pipeline = append(pipeline,
+			bson.M{"$match": query},
+			bson.M{"$project": bson.M{"_id": 1}},
+			bson.M{"$sample": bson.M{"size": size}},
+		)
+	} else {
+		pipeline = append(pipeline,
+			bson.M{"$sample": bson.M{"size": size}},
+			bson.M{"$project": bson.M{"_id": 1}},
+		)
+	}
+	return append(pipeline, bson.M{"$sort": bson.M{"_id": 1}})
+}
+
+// partitionSamples picks up to n _id ranges from the sampled documents
+func partitionSamples(table config.Table, samples []bson.M, n int) []idRange {
+	ids := make([]interface{}, len(samples))
+	for i, sample := range samples {
+		ids[i] = mongosource.Value(sample["_id"])
+	}
+	if !sameTypeClass(ids) {
+		log.WarnD("partition-mixed-id-types", logger.M{"collection": table.Source})
+		return []idRange{{}}
+	}
+
+	ranges := []idRange{}
+	var min interface{}
+	for _, b := range pickBoundaries(ids, n) {
+		ranges = append(ranges, idRange{Min: min, Max: b})
+		min = b
+	}
+	return append(ranges, idRange{Min: min})
+}
+
+// pickBoundaries chooses up to n-1 evenly spaced, distinct values from the sorted ids
+func pickBoundaries(ids []interface{}, n int) []interface{} {
+	boundaries := []interface{}{}
+	for i := 1; i < n; i++ {
+		idx := i * len(ids) / n
+		if idx == 0 || idx >= len(ids) {
+			continue
+		}
+		// $sample can return the same document more than once
+		if len(boundaries) > 0 && boundaries[len(boundaries)-1] == ids[idx] {
+			continue
+		}
+		boundaries = append(boundaries, ids[idx])
+	}
+	return boundaries
+}
+
+// sameTypeClass checks that mongo will compare all of the values against each other,
+// i.e. that they're all the same BSON type. Numbers are compared across types.
+func sameTypeClass(values []interface{}) bool {
+	class := ""
+	for _, v := range values {
+		var c string
+		switch v.(type) {
+		case int, int64, float64:
+			c = "number"
+		case string:
+			c = "string"
+		case primitive.ObjectID:
+			c = "objectid"
+		case time.Time:
+			c = "date"
+		default:
+			return false
+		}
+		if class != "" && c != class {
+			return false
+		}
+		class = c
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package exporter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/store"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// stagedFile is a data file written to the run's staging prefix, and the key it's
+// published to once the whole export has been verified
+type stagedFile struct {
+	Staged string
+	Final  string
+}
+
+// newRunID returns a unique ID for a run, sortable by start time
+func newRunID(start time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%s", start.UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix))
+}
+
+// stagingPrefix is where a run writes its data files before they're published. It sits
+// outside the dated partitions so partial runs are never picked up by a load.
+func stagingPrefix(collectionName, runID string) string {
+	return fmt.Sprintf("mongo_raw/%s/_staging/%s/", collectionName, runID)
+}
+
+// stageFile returns where a data file is staged before it's published to finalName
+func stageFile(collectionName, runID, finalName string) stagedFile {
+	return stagedFile{
+		Staged: stagingPrefix(collectionName, runID) + path.Base(finalName),
+		Final:  finalName,
+	}
+}
+
+// publishFiles copies staged files to their final keys
+func publishFiles(ctx context.Context, output store.ObjectStore, files []stagedFile) error {
+	for _, f := range files {
+		log.InfoD("publishing-file", logger.M{"from": output.URL(f.Staged), "to": output.URL(f.Final)})
+		if err := output.Copy(ctx, f.Staged, f.Final); err != nil {
+			return fmt.Errorf("failed to publish %s: %s", f.Final, err)
+		}
+	}
+	return nil
+}
+
+// cleanupStaging deletes everything under a run's staging prefix. Failures are only
+// logged since there's nothing more useful to do with them.
+func cleanupStaging(output store.ObjectStore, prefix string) {
+	keys, err := output.List(prefix)
+	if err != nil {
+		log.ErrorD("staging-cleanup-error", logger.M{"prefix": prefix, "error": err.Error()})
+		return
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := output.Delete(key); err != nil {
+			log.ErrorD("staging-cleanup-error", logger.M{"key": key, "error": err.Error()})
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package exporter
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"time"
+
+	json "github.com/pquerna/ffjson/ffjson"
+)
+
+// Debounce decisions recorded in the run report
+const (
+	debounceSkipped = "skipped" // the skipDebounce flag was set
+	debounceFresh   = "fresh"   // the table was loaded recently, so the export was skipped
+	debounceStale   = "stale"   // the table is due a load, so the export ran
+)
+
+// fileReport describes a single data file written by a run
+type fileReport struct {
+	Name  string `json:"name"`
+	Rows  int64  `json:"rows"`
+	Bytes int64  `json:"bytes"`
+}
+
+// runReport is a machine readable summary of a run, uploaded alongside the manifest so
+// dashboards and audits don't have to piece it together from the logs
+type runReport struct {
+	Version          string           `json:"version"`
+	Config           string           `json:"config"`
+	Collection       string           `json:"collection"`
+	Destination      string           `json:"destination"`
+	MongoHost        string           `json:"mongo_host"`
+	Timestamp        string           `json:"timestamp"`
+	StartTime        time.Time        `json:"start_time"`
+	EndTime          time.Time        `json:"end_time"`
+	DebounceDecision string           `json:"debounce_decision"`
+	Encryption       string           `json:"encryption"`
+	Incremental      bool             `json:"incremental"`
+	RowsRead         int64            `json:"rows_read"`
+	RowsWritten      int64            `json:"rows_written"`
+	Files            []fileReport     `json:"files"`
+	CoercionErrors   map[string]int64 `json:"type_coercion_errors"`
+	LengthViolations map[string]int64 `json:"length_violations"`
+}
+
+// reader finishes the report and returns it as JSON
+func (r *runReport) reader() (io.Reader, error) {
+	r.EndTime = time.Now().UTC()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.count, int64(n))
+	return n, err
+}
+
+// bytesWritten is the number of bytes written so far
+func (c *countingWriter) bytesWritten() int64 {
+	return atomic.LoadInt64(&c.count)
+}
@@ -0,0 +1,159 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/mongosource"
+	"github.com/Clever/mongo-to-s3/store"
+	json "github.com/pquerna/ffjson/ffjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// typedValue is a JSON-friendly representation of a BSON value that keeps enough
+// type information to rebuild the original value for a mongo query
+type typedValue struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// watermark is the high-water mark of an incremental export, persisted after every
+// successful run so the next one only has to pull newer documents
+type watermark struct {
+	Field     string     `json:"field"`
+	Value     typedValue `json:"value"`
+	Timestamp string     `json:"timestamp"`
+}
+
+func encodeValue(v interface{}) (typedValue, error) {
+	switch val := v.(type) {
+	case primitive.ObjectID:
+		return typedValue{Type: "objectid", Value: val.Hex()}, nil
+	case time.Time:
+		return typedValue{Type: "date", Value: val.UTC().Format(time.RFC3339Nano)}, nil
+	case int:
+		return typedValue{Type: "int", Value: strconv.Itoa(val)}, nil
+	case int64:
+		return typedValue{Type: "int", Value: strconv.FormatInt(val, 10)}, nil
+	case float64:
+		return typedValue{Type: "float", Value: strconv.FormatFloat(val, 'g', -1, 64)}, nil
+	case string:
+		return typedValue{Type: "string", Value: val}, nil
+	}
+	return typedValue{}, fmt.Errorf("unsupported watermark value type %T", v)
+}
+
+func decodeValue(v typedValue) (interface{}, error) {
+	switch v.Type {
+	case "objectid":
+		id, err := primitive.ObjectIDFromHex(v.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid objectid '%s'", v.Value)
+		}
+		return id, nil
+	case "date":
+		return time.Parse(time.RFC3339Nano, v.Value)
+	case "int":
+		return strconv.ParseInt(v.Value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(v.Value, 64)
+	case "string":
+		return v.Value, nil
+	}
+	return nil, fmt.Errorf("unknown watermark value type '%s'", v.Type)
+}
+
+// watermarkFilename is where the high-water mark for a destination table lives.
+// It sits outside the dated partitions since it's carried over between runs.
+func watermarkFilename(collectionName string) string {
+	return fmt.Sprintf("mongo_raw/%s/_watermark.json", collectionName)
+}
+
+// readWatermark fetches the last saved high-water mark for a destination table.
+// It returns nil if no incremental run has completed yet.
+func readWatermark(output store.ObjectStore, collectionName string) (*watermark, error) {
+	data, err := output.Get(watermarkFilename(collectionName))
+	if err == store.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var w watermark
+	if err := json.Unmarshal(data, &w); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// writeWatermark saves the high-water mark so the next run can pick up where this one stopped
+func writeWatermark(output store.ObjectStore, collectionName string, w watermark) error {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	outName := watermarkFilename(collectionName)
+	log.InfoD("watermark-file-upload", logger.M{"path": output.URL(outName), "field": w.Field, "value": w.Value.Value})
+	return output.PutBytes(outName, data)
+}
+
+// incrementalQuery builds the mongo query for an export. It returns an empty query,
+// i.e. a full export, if there is no previous watermark for the configured field.
+func incrementalQuery(field string, previous *watermark) (bson.M, bool, error) {
+	if previous == nil || previous.Field != field {
+		return bson.M{}, false, nil
+	}
+	val, err := decodeValue(previous.Value)
+	if err != nil {
+		return nil, false, err
+	}
+	return bson.M{field: bson.M{"$gt": val}}, true, nil
+}
+
+// nextWatermark looks up the largest value of the incremental field matching the query.
+// We take it before reading so documents written during the export are picked up again
+// next time rather than skipped. Returns nil if nothing matches.
+func nextWatermark(ctx context.Context, db *mongo.Database, table config.Table, query bson.M, timestamp string) (*watermark, error) {
+	field := table.Meta.IncrementalField
+	opts := options.FindOne().SetSort(bson.D{{Key: field, Value: -1}}).SetProjection(bson.M{field: 1})
+	doc := bson.M{}
+	err := db.Collection(table.Source).FindOne(ctx, query, opts).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	val, ok := lookupPath(mongosource.Document(doc), field)
+	if !ok {
+		return nil, nil
+	}
+	encoded, err := encodeValue(val)
+	if err != nil {
+		return nil, err
+	}
+	return &watermark{Field: field, Value: encoded, Timestamp: timestamp}, nil
+}
+
+// lookupPath finds a value in a nested document by its dot-separated path
+func lookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.SplitN(path, ".", 2)
+	val, ok := doc[parts[0]]
+	if !ok || len(parts) == 1 {
+		return val, ok
+	}
+	switch sub := val.(type) {
+	case bson.M:
+		return lookupPath(sub, parts[1])
+	case map[string]interface{}:
+		return lookupPath(sub, parts[1])
+	}
+	return nil, false
+}
@@ -6,10 +6,9 @@ require (
 	github.com/Clever/analytics-latency-config-service v0.2.1
 	github.com/Clever/analytics-util v1.2.1
 	github.com/Clever/discovery-go v1.4.1-0.20160421203403-12684ef3012b
-	github.com/Clever/pathio v3.1.2-0.20160428201732-0e1d760e1bb1+incompatible
 	github.com/afex/hystrix-go v0.0.0-20180502004556-fa1af6a1f4f5 // indirect
 	github.com/asaskevich/govalidator v0.0.0-20200817114649-df4adffc9d8c // indirect
-	github.com/aws/aws-sdk-go v1.29.15
+	github.com/aws/aws-sdk-go v1.30.19
 	github.com/donovanhide/eventsource v0.0.0-20171031113327-3ed64d21fb0b // indirect
 	github.com/facebookgo/ensure v0.0.0-20200202191622-63f1cf65ac4c // indirect
 	github.com/facebookgo/errgroup v0.0.0-20160209021148-779c8d7ef069 // indirect
@@ -25,15 +24,16 @@ require (
 	github.com/opentracing/opentracing-go v1.2.0 // indirect
 	github.com/pquerna/ffjson v0.0.0-20180717144149-af8b230fcd20
 	github.com/smartystreets/goconvey v1.6.4 // indirect
-	github.com/stretchr/testify v1.6.1
+	github.com/stretchr/testify v1.7.0
 	github.com/xeipuuv/gojsonpointer v0.0.0-20180127040702-4e3ac2762d5f // indirect
 	github.com/xeipuuv/gojsonreference v0.0.0-20180127040603-bd5ef7bd5415 // indirect
 	github.com/xeipuuv/gojsonschema v1.1.1-0.20190414155507-6c00ba4a5316 // indirect
-	go.mongodb.org/mongo-driver v1.4.1 // indirect
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	go.mongodb.org/mongo-driver v1.4.1
 	gopkg.in/Clever/kayvee-go.v3 v3.0.0 // indirect
 	gopkg.in/Clever/kayvee-go.v6 v6.24.0
 	gopkg.in/Clever/optimus.v3 v3.7.0
 	gopkg.in/fatih/set.v0 v0.1.0 // indirect
-	gopkg.in/mgo.v2 v2.0.0-20160316054952-b6e2fa371e64
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Clever/mongo-to-s3/cluster"
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/mongosource"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// piiHints are substrings of field names that usually hold personal information
+var piiHints = []string{
+	"email", "phone", "name", "address", "street", "zip", "postal", "birth", "dob",
+	"ssn", "password", "gender", "ethnicity", "race", "lunch", "iep", "ell",
+}
+
+var nonIdentifierChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// inferCommand samples documents from a collection and prints a config table stanza
+// covering every field path seen, to be edited and added to a config. It returns the exit code.
+//
+//	mongo-to-s3 infer --config NAME --collection X --sample N
+func inferCommand(args []string) int {
+	fs := flag.NewFlagSet("infer", flag.ExitOnError)
+	name := fs.String("config", "", "The cluster to sample from (required)")
+	collection := fs.String("collection", "", "The mongo collection to sample (required)")
+	sample := fs.Int("sample", 1000, "The number of documents to sample")
+	fs.Parse(args)
+	if *name == "" || *collection == "" || *sample < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	registry, err := cluster.FromEnv(os.Environ())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	c, err := registry.Lookup(*name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ctx := context.Background()
+	db, err := c.Dial(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mongo connection failed: %s\n", err)
+		return 1
+	}
+	defer db.Client().Disconnect(ctx)
+
+	tally := config.NewSchemaTally()
+	flatten := config.Flattener()
+	cursor, err := db.Collection(*collection).Aggregate(ctx, []bson.M{{"$sample": bson.M{"size": *sample}}})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sampling '%s' failed: %s\n", *collection, err)
+		return 1
+	}
+	// documents are read the same way an export reads them, so they flatten the same way
+	docs := mongosource.New(ctx, cursor)
+	defer docs.Stop()
+	for doc := range docs.Rows() {
+		row, err := flatten(doc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "flattening document failed: %s\n", err)
+			return 1
+		}
+		tally.Add(row)
+	}
+	if err := docs.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "sampling '%s' failed: %s\n", *collection, err)
+		return 1
+	}
+	if tally.Rows == 0 {
+		fmt.Fprintf(os.Stderr, "no documents found in '%s'\n", *collection)
+		return 1
+	}
+
+	fmt.Print(proposeTableConfig(*collection, tally))
+	return 0
+}
+
+// proposeTableConfig renders a config table stanza for the sampled paths, with the stats for
+// each column in a comment. Fields that look like personal information are marked as pii.
+func proposeTableConfig(collection string, tally *config.SchemaTally) string {
+	var buf bytes.Buffer
+	dataDateColumn := "_data_timestamp"
+	fmt.Fprintf(&buf, "%s:\n", collection)
+	fmt.Fprintf(&buf, "  dest: %s\n", suggestDestination(collection))
+	fmt.Fprintf(&buf, "  source: %s\n", yamlString(collection))
+	fmt.Fprintf(&buf, "  columns:\n")
+	fmt.Fprintf(&buf, "  -\n    dest: %s\n    type: %s\n    sortord: 1\n", dataDateColumn, config.TypeTimestamp)
+
+	// put _id first since it's the primary key
+	paths := tally.SortedPaths()
+	sort.SliceStable(paths, func(i, j int) bool { return paths[i] == "_id" && paths[j] != "_id" })
+
+	used := map[string]bool{dataDateColumn: true}
+	for _, path := range paths {
+		stats := *tally.Paths[path]
+		dest := suggestDestination(path)
+		for i := 2; used[dest]; i++ {
+			dest = fmt.Sprintf("%s_%d", suggestDestination(path), i)
+		}
+		used[dest] = true
+
+		types := []string{}
+		for typeName, count := range stats.Types {
+			types = append(types, fmt.Sprintf("%s=%d", typeName, count))
+		}
+		sort.Strings(types)
+		nullRate := 100 * float64(tally.Rows-stats.Count+stats.Nulls) / float64(tally.Rows)
+		fmt.Fprintf(&buf, "  # seen in %d of %d documents, %.1f%% null or missing, types: %s\n",
+			stats.Count, tally.Rows, nullRate, strings.Join(types, " "))
+
+		columnType := config.SuggestType(stats)
+		pii := likelyPII(path)
+		if pii {
+			fmt.Fprintf(&buf, "  # REVIEW: this looks like personal information so is exported as whether it exists\n")
+			columnType = config.TypeBoolean
+		}
+		fmt.Fprintf(&buf, "  -\n    dest: %s\n    source: %s\n    type: %s\n", dest, yamlString(path), columnType)
+		if pii {
+			fmt.Fprintf(&buf, "    pii: true\n")
+		}
+		if path == "_id" {
+			fmt.Fprintf(&buf, "    primarykey: true\n    notnull: true\n    distkey: true\n")
+		}
+	}
+
+	fmt.Fprintf(&buf, "  meta:\n    datadatecolumn: %s\n", dataDateColumn)
+	return buf.String()
+}
+
+// suggestDestination turns a mongo field path into a Redshift friendly column name,
+// e.g. data.name.first becomes data_name_first and _id becomes id
+func suggestDestination(path string) string {
+	dest := strings.Trim(nonIdentifierChars.ReplaceAllString(strings.ToLower(path), "_"), "_")
+	if dest == "" {
+		return "column"
+	}
+	return dest
+}
+
+// likelyPII guesses whether a field holds personal information from the names in its path
+func likelyPII(path string) bool {
+	for _, part := range strings.Split(strings.ToLower(path), ".") {
+		for _, hint := range piiHints {
+			// short hints would match too many unrelated names as substrings
+			if part == hint || (len(hint) > 3 && strings.Contains(part, hint)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var plainYAMLString = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// yamlString quotes a string if it wouldn't be read back as the same string from plain YAML
+func yamlString(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null":
+		return strconv.Quote(s)
+	}
+	if plainYAMLString.MatchString(s) {
+		return s
+	}
+	return strconv.Quote(s)
+}
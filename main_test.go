@@ -1,28 +1,117 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/Clever/mongo-to-s3/cluster"
+	"github.com/Clever/mongo-to-s3/config"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
 )
 
-func TestCreateManifest(t *testing.T) {
-	reader, err := createManifest("bucket", []string{"foo", "bar"})
+func TestProposeTableConfig(t *testing.T) {
+	tally := config.NewSchemaTally()
+	tally.Add(optimus.Row{"_id": primitive.NewObjectID(), "name.first": "Ada", "grade": 5, "created": time.Now()})
+	tally.Add(optimus.Row{"_id": primitive.NewObjectID(), "grade": nil})
+
+	proposal := proposeTableConfig("students", tally)
+	assert.Equal(t, `students:
+  dest: students
+  source: students
+  columns:
+  -
+    dest: _data_timestamp
+    type: timestamp
+    sortord: 1
+  # seen in 2 of 2 documents, 0.0% null or missing, types: objectId=2
+  -
+    dest: id
+    source: _id
+    type: text
+    primarykey: true
+    notnull: true
+    distkey: true
+  # seen in 1 of 2 documents, 50.0% null or missing, types: date=1
+  -
+    dest: created
+    source: created
+    type: timestamp
+  # seen in 2 of 2 documents, 50.0% null or missing, types: int=1
+  -
+    dest: grade
+    source: grade
+    type: int
+  # seen in 1 of 2 documents, 50.0% null or missing, types: string=1
+  # REVIEW: this looks like personal information so is exported as whether it exists
+  -
+    dest: name_first
+    source: name.first
+    type: boolean
+    pii: true
+  meta:
+    datadatecolumn: _data_timestamp
+`, proposal)
+
+	// the proposal should be a valid config
+	conf, err := config.ParseYAML([]byte(proposal))
 	assert.NoError(t, err)
-	expectedManifest := &Manifest{
-		EntryArray{
-			map[string]interface{}{"url": "s3://bucket/foo", "mandatory": true},
-			map[string]interface{}{"url": "s3://bucket/bar", "mandatory": true},
-		},
+	assert.Empty(t, conf.Validate())
+}
+
+func TestSuggestDestination(t *testing.T) {
+	assert.Equal(t, "id", suggestDestination("_id"))
+	assert.Equal(t, "data_name_first", suggestDestination("data.name.first"))
+	assert.Equal(t, "schoolyear", suggestDestination("schoolYear"))
+	assert.Equal(t, "a_b", suggestDestination("a$-b"))
+	assert.Equal(t, "_id", yamlString("_id"))
+	assert.Equal(t, `"null"`, yamlString("null"))
+	assert.Equal(t, `"a b"`, yamlString("a b"))
+}
+
+func TestContextWithSignals(t *testing.T) {
+	ctx, stop := contextWithSignals(context.Background(), syscall.SIGUSR1)
+	defer stop()
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context wasn't cancelled by the signal")
 	}
 
-	bytes, err := ioutil.ReadAll(reader)
+	ctx, stop = contextWithSignals(context.Background(), syscall.SIGUSR1)
+	stop()
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test")
 	assert.NoError(t, err)
-	manifest := &Manifest{}
-	err = json.Unmarshal(bytes, manifest)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sis.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("from: file"), 0600))
+
+	registry, err := cluster.FromEnv([]string{"MONGO_TO_S3_CLUSTERS_SIS_CONFIG=from: env", "MONGO_TO_S3_CLUSTERS_IL_URL=mongodb://il"})
+	assert.NoError(t, err)
+
+	conf, err := loadConfig("sis", registry)
 	assert.NoError(t, err)
-	// check that the manifest entries match
-	assert.Equal(t, expectedManifest.Entries, manifest.Entries)
+	assert.Equal(t, exportConfig{Name: "sis", Source: "cluster sis (MONGO_TO_S3_CLUSTERS_SIS_*)", Data: "from: env", Cluster: "sis"}, conf)
+
+	for _, ref := range []string{path, "file://" + path} {
+		conf, err = loadConfig(ref, registry)
+		assert.NoError(t, err)
+		assert.Equal(t, exportConfig{Name: "sis", Source: "file://" + path, Data: "from: file"}, conf)
+	}
+
+	for _, ref := range []string{"il", "misc", filepath.Join(dir, "missing.yml"), "gs://bucket/sis.yml"} {
+		_, err := loadConfig(ref, registry)
+		assert.Error(t, err, ref)
+	}
 }
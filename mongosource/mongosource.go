@@ -0,0 +1,190 @@
+// Package mongosource is an optimus table over a mongo-driver cursor. It replaces optimus's
+// mgo source, and hands out documents in the same shape that one did so they're flattened
+// and coerced the same way.
+package mongosource
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// Cursor is the part of a *mongo.Cursor the table reads from
+type Cursor interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// table is an optimus table of a cursor's documents
+type table struct {
+	cursor   Cursor
+	ctx      context.Context
+	cancel   func()
+	rows     chan optimus.Row
+	err      error
+	stopOnce sync.Once
+}
+
+// New returns a table of the cursor's documents. The cursor is closed, killing it on the
+// server, once it's been read through or the table is stopped. Cancelling ctx stops the
+// table with ctx's error.
+func New(ctx context.Context, cursor Cursor) optimus.Table {
+	ctx, cancel := context.WithCancel(ctx)
+	t := &table{cursor: cursor, ctx: ctx, cancel: cancel, rows: make(chan optimus.Row)}
+	go t.start()
+	return t
+}
+
+func (t *table) start() {
+	defer close(t.rows)
+	// ctx is done by the time the cursor's closed if the table was stopped
+	defer t.cursor.Close(context.Background())
+	for t.cursor.Next(t.ctx) {
+		doc := bson.M{}
+		if err := t.cursor.Decode(&doc); err != nil {
+			t.err = err
+			return
+		}
+		select {
+		case t.rows <- optimus.Row(Document(doc)):
+		case <-t.ctx.Done():
+			t.err = t.ctx.Err()
+			return
+		}
+	}
+	t.err = t.cursor.Err()
+}
+
+func (t *table) Rows() <-chan optimus.Row {
+	return t.rows
+}
+
+func (t *table) Err() error {
+	return t.err
+}
+
+func (t *table) Stop() {
+	t.stopOnce.Do(t.cancel)
+}
+
+// RegEx is a regular expression. It has the same shape as the mgo type regular
+// expressions were decoded to, so it's converted to text the same way, as do JavaScript
+// and Symbol.
+type RegEx struct {
+	Pattern string
+	Options string
+}
+
+// JavaScript is code, with the scope it was saved with if any
+type JavaScript struct {
+	Code  string
+	Scope interface{}
+}
+
+// Symbol is a deprecated BSON symbol
+type Symbol string
+
+// Undefined is the deprecated BSON undefined value. mgo decoded it to an empty struct
+// rather than nil, so it's written out as {}.
+type Undefined struct{}
+
+// OrderKey is a BSON min or max key, which mgo decoded to the smallest or largest int64
+type OrderKey int64
+
+// The values min and max keys are converted to
+const (
+	MinKey OrderKey = -1 << 63
+	MaxKey OrderKey = 1<<63 - 1
+)
+
+// Document converts a document decoded by the driver to the types mgo decoded it to
+func Document(doc bson.M) map[string]interface{} {
+	return Value(doc).(map[string]interface{})
+}
+
+// Value converts a value decoded by the driver to the type mgo decoded it to:
+//
+//   - documents, whether primitive.M or primitive.D, become map[string]interface{}
+//   - arrays become []interface{}
+//   - dates become time.Time
+//   - 32-bit ints become int
+//   - generic binary data becomes []byte
+//   - timestamps become int64
+//   - regular expressions, code, symbols and undefined become RegEx, JavaScript, Symbol and Undefined
+//   - min and max keys become MinKey and MaxKey
+//   - null becomes nil
+//   - decimals become their string form, since mgo had nothing better to decode them to
+//
+// Everything else, including ObjectIDs, is left as it is.
+func Value(v interface{}) interface{} {
+	switch val := v.(type) {
+	case primitive.M:
+		doc := make(map[string]interface{}, len(val))
+		for k, sub := range val {
+			doc[k] = Value(sub)
+		}
+		return doc
+	case map[string]interface{}:
+		doc := make(map[string]interface{}, len(val))
+		for k, sub := range val {
+			doc[k] = Value(sub)
+		}
+		return doc
+	case primitive.D:
+		doc := make(map[string]interface{}, len(val))
+		for _, e := range val {
+			doc[e.Key] = Value(e.Value)
+		}
+		return doc
+	case primitive.A:
+		return Value([]interface{}(val))
+	case []interface{}:
+		array := make([]interface{}, len(val))
+		for i, sub := range val {
+			array[i] = Value(sub)
+		}
+		return array
+	case primitive.DateTime:
+		ms := int64(val)
+		// mgo decoded the zero time.Time's milliseconds back to the zero time.Time
+		if ms == -62135596800000 {
+			return time.Time{}
+		}
+		return time.Unix(ms/1e3, ms%1e3*1e6)
+	case int32:
+		return int(val)
+	case primitive.Binary:
+		// the generic and old generic subtypes
+		if val.Subtype == 0x00 || val.Subtype == 0x02 {
+			return val.Data
+		}
+		return val
+	case primitive.Timestamp:
+		return int64(val.T)<<32 | int64(val.I)
+	case primitive.Regex:
+		return RegEx{Pattern: val.Pattern, Options: val.Options}
+	case primitive.JavaScript:
+		return JavaScript{Code: string(val)}
+	case primitive.CodeWithScope:
+		return JavaScript{Code: string(val.Code), Scope: Value(val.Scope)}
+	case primitive.Symbol:
+		return Symbol(val)
+	case primitive.Undefined:
+		return Undefined{}
+	case primitive.MinKey:
+		return MinKey
+	case primitive.MaxKey:
+		return MaxKey
+	case primitive.Null:
+		return nil
+	case primitive.Decimal128:
+		return val.String()
+	}
+	return v
+}
@@ -0,0 +1,189 @@
+package mongosource
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// sliceCursor is a cursor over documents encoded by the driver, so they're decoded the
+// same way as ones read from mongo
+type sliceCursor struct {
+	docs   [][]byte
+	next   int
+	err    error
+	closed bool
+}
+
+func newSliceCursor(t *testing.T, docs ...interface{}) *sliceCursor {
+	c := &sliceCursor{next: -1}
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		assert.NoError(t, err)
+		c.docs = append(c.docs, raw)
+	}
+	return c
+}
+
+func (c *sliceCursor) Next(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		c.err = ctx.Err()
+		return false
+	}
+	c.next++
+	return c.next < len(c.docs)
+}
+
+func (c *sliceCursor) Decode(val interface{}) error {
+	return bson.Unmarshal(c.docs[c.next], val)
+}
+
+func (c *sliceCursor) Err() error {
+	return c.err
+}
+
+func (c *sliceCursor) Close(ctx context.Context) error {
+	c.closed = true
+	return nil
+}
+
+func TestTable(t *testing.T) {
+	id := primitive.NewObjectID()
+	created := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	decimal, err := primitive.ParseDecimal128("12.50")
+	assert.NoError(t, err)
+	cursor := newSliceCursor(t,
+		bson.D{
+			{Key: "_id", Value: id},
+			{Key: "created", Value: created},
+			{Key: "grade", Value: int32(5)},
+			{Key: "count", Value: int64(7)},
+			{Key: "name", Value: bson.D{{Key: "first", Value: "Ada"}, {Key: "last", Value: "Lovelace"}}},
+			{Key: "tags", Value: bson.A{"a", bson.M{"b": int32(1)}}},
+			{Key: "data", Value: primitive.Binary{Data: []byte("raw")}},
+			{Key: "uuid", Value: primitive.Binary{Subtype: 0x04, Data: []byte("0123456789abcdef")}},
+			{Key: "ts", Value: primitive.Timestamp{T: 1, I: 2}},
+			{Key: "missing", Value: nil},
+			{Key: "undefined", Value: primitive.Undefined{}},
+			{Key: "min", Value: primitive.MinKey{}},
+			{Key: "pattern", Value: primitive.Regex{Pattern: "^a", Options: "i"}},
+			{Key: "symbol", Value: primitive.Symbol("sym")},
+			{Key: "price", Value: decimal},
+		},
+		bson.M{"_id": "second"},
+	)
+
+	rows := []optimus.Row{}
+	table := New(context.Background(), cursor)
+	for row := range table.Rows() {
+		rows = append(rows, row)
+	}
+	assert.NoError(t, table.Err())
+	assert.True(t, cursor.closed)
+	assert.Equal(t, []optimus.Row{
+		{
+			"_id":       id,
+			"created":   created.Local(),
+			"grade":     5,
+			"count":     int64(7),
+			"name":      map[string]interface{}{"first": "Ada", "last": "Lovelace"},
+			"tags":      []interface{}{"a", map[string]interface{}{"b": 1}},
+			"data":      []byte("raw"),
+			"uuid":      primitive.Binary{Subtype: 0x04, Data: []byte("0123456789abcdef")},
+			"ts":        int64(1)<<32 | 2,
+			"missing":   nil,
+			"undefined": Undefined{},
+			"min":       MinKey,
+			"pattern":   RegEx{Pattern: "^a", Options: "i"},
+			"symbol":    Symbol("sym"),
+			"price":     "12.50",
+		},
+		{"_id": "second"},
+	}, rows)
+
+	// nested documents are flattened the way they were with mgo
+	flattened, err := config.Flattener()(rows[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "Ada", flattened["name.first"])
+	assert.Equal(t, `["a",{"b":1}]`, flattened["tags"])
+	assert.Equal(t, 1, flattened["tags.b"])
+
+	// and converted to text the same way too
+	for field, want := range map[string]string{
+		"pattern":   `{"Pattern":"^a","Options":"i"}`,
+		"symbol":    `"sym"`,
+		"price":     "12.50",
+		"undefined": "{}",
+		"min":       "-9223372036854775808",
+	} {
+		text, err := config.CoerceValue(config.TypeText, flattened[field])
+		assert.NoError(t, err)
+		assert.Equal(t, want, text, field)
+	}
+}
+
+func TestTableStop(t *testing.T) {
+	docs := []interface{}{}
+	for i := 0; i < 10; i++ {
+		docs = append(docs, bson.M{"_id": i})
+	}
+	cursor := newSliceCursor(t, docs...)
+	table := New(context.Background(), cursor)
+	<-table.Rows()
+	table.Stop()
+	for range table.Rows() {
+	}
+	assert.True(t, cursor.closed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	table = New(ctx, newSliceCursor(t, docs...))
+	for range table.Rows() {
+	}
+	assert.Equal(t, context.Canceled, table.Err())
+}
+
+func TestValue(t *testing.T) {
+	assert.Equal(t, time.Time{}, Value(primitive.DateTime(-62135596800000)))
+	assert.Equal(t, time.Unix(1, 500000000), Value(primitive.DateTime(1500)))
+	assert.Equal(t, []interface{}{1, "b"}, Value(primitive.A{int32(1), "b"}))
+	assert.Equal(t, map[string]interface{}{"a": map[string]interface{}{"b": 1}}, Value(primitive.M{"a": primitive.D{{Key: "b", Value: int32(1)}}}))
+	assert.Equal(t, "unchanged", Value("unchanged"))
+	assert.Equal(t, 1.5, Value(1.5))
+	assert.Equal(t, RegEx{Pattern: "^a", Options: "i"}, Value(primitive.Regex{Pattern: "^a", Options: "i"}))
+	assert.Equal(t, JavaScript{Code: "x()"}, Value(primitive.JavaScript("x()")))
+	assert.Equal(t, JavaScript{Code: "x()", Scope: map[string]interface{}{"x": 1}},
+		Value(primitive.CodeWithScope{Code: "x()", Scope: primitive.D{{Key: "x", Value: int32(1)}}}))
+	assert.Equal(t, Symbol("sym"), Value(primitive.Symbol("sym")))
+	assert.Nil(t, Value(primitive.Null{}))
+	decimal, err := primitive.ParseDecimal128("12.50")
+	assert.NoError(t, err)
+	assert.Equal(t, "12.50", Value(decimal))
+}
+
+func TestValueLikeMgo(t *testing.T) {
+	// types mgo had its own values for, and the JSON they were written out as
+	for _, test := range []struct {
+		value    interface{}
+		expected interface{}
+		json     string
+	}{
+		{primitive.Undefined{}, Undefined{}, `{}`},
+		{primitive.MinKey{}, MinKey, `-9223372036854775808`},
+		{primitive.MaxKey{}, MaxKey, `9223372036854775807`},
+		{primitive.Null{}, nil, `null`},
+	} {
+		converted := Value(test.value)
+		assert.Equal(t, test.expected, converted)
+		encoded, err := json.Marshal(converted)
+		assert.NoError(t, err)
+		assert.Equal(t, test.json, string(encoded))
+	}
+}
@@ -0,0 +1,260 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Server side encryption settings for s3
+const (
+	SSEAES256 = "AES256"
+	SSEKMS    = "aws:kms"
+	SSENone   = "none"
+)
+
+// Encryption configures how objects are encrypted when they're written
+type Encryption struct {
+	// SSE is the server side encryption s3 applies: AES256, aws:kms or none. The default
+	// is AES256 on AWS and none on other s3 compatible services, e.g. MinIO without KMS.
+	SSE string
+	// KMSKeyID and KMSContext are used with aws:kms. An empty key ID uses the account's default s3 key.
+	KMSKeyID   string
+	KMSContext map[string]string
+	// ClientKey is a 32 byte key. When set, objects are encrypted in the s3 encryption
+	// client's envelope before they're written, so Redshift can load them with the key.
+	ClientKey []byte
+}
+
+// WithEncryption returns a store that encrypts objects as they're written. Server side
+// settings are ignored by the local store, which has no equivalent. Client encrypted
+// objects can only be read back through a store with the same key.
+func WithEncryption(s ObjectStore, enc Encryption) (ObjectStore, error) {
+	switch enc.SSE {
+	case "", SSEAES256, SSENone:
+		if enc.KMSKeyID != "" || len(enc.KMSContext) > 0 {
+			return nil, fmt.Errorf("a kms key or context requires sse %s", SSEKMS)
+		}
+	case SSEKMS:
+	default:
+		return nil, fmt.Errorf("unknown sse '%s'", enc.SSE)
+	}
+
+	if plain, ok := s.(*s3Store); ok {
+		encrypted := newS3Store(plain.bucket, plain.prefix, plain.opts)
+		encrypted.sse = enc
+		s = encrypted
+	}
+	if enc.ClientKey == nil {
+		return s, nil
+	}
+	if len(enc.ClientKey) != 32 {
+		return nil, fmt.Errorf("client encryption key must be 32 bytes, got %d", len(enc.ClientKey))
+	}
+	withMetadata, ok := s.(metadataStore)
+	if !ok {
+		return nil, fmt.Errorf("client encryption isn't supported by %s", s.URL(""))
+	}
+	return &encryptedStore{metadataStore: withMetadata, key: enc.ClientKey}, nil
+}
+
+// ReadKeyFile reads a 32 byte client encryption key, stored either raw or base64 encoded
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("key file '%s' must hold 32 bytes, raw or base64 encoded", path)
+	}
+	return key, nil
+}
+
+// Client side encrypted objects use the s3 encryption client's envelope, which is what
+// Redshift's COPY ... ENCRYPTED MASTER_SYMMETRIC_KEY loads. Each object gets a random
+// 256 bit data key and IV, and its body is encrypted with AES-CBC and PKCS#7 padding. The
+// data key is encrypted with the configured key using AES-ECB and stored base64 encoded
+// in the object's x-amz-key metadata, along with the IV in x-amz-iv. The envelope isn't
+// authenticated, so a corrupt object may decrypt to garbage rather than fail.
+const (
+	metadataKey     = "x-amz-key"
+	metadataIV      = "x-amz-iv"
+	metadataMatDesc = "x-amz-matdesc"
+	chunkSize       = 64 * 1024
+)
+
+var errCorrupt = errors.New("encrypted object is corrupt or was encrypted with a different key")
+
+// metadataStore is a store that keeps metadata with its objects, which client encrypted
+// objects need for their data key
+type metadataStore interface {
+	ObjectStore
+	putWithMetadata(ctx context.Context, key string, body io.Reader, metadata map[string]string) error
+	getWithMetadata(key string) ([]byte, map[string]string, error)
+}
+
+// encryptedStore encrypts objects before passing them on to the underlying store
+type encryptedStore struct {
+	metadataStore
+	key []byte
+}
+
+func (e *encryptedStore) Put(ctx context.Context, key string, body io.Reader) error {
+	dataKey := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return err
+	}
+	wrapped, err := wrapKey(e.key, dataKey)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return err
+	}
+	metadata := map[string]string{
+		metadataKey:     base64.StdEncoding.EncodeToString(wrapped),
+		metadataIV:      base64.StdEncoding.EncodeToString(iv),
+		metadataMatDesc: "{}",
+	}
+	encrypted := &encryptingReader{r: body, mode: cipher.NewCBCEncrypter(block, iv), buf: make([]byte, chunkSize, chunkSize+aes.BlockSize)}
+	return e.putWithMetadata(ctx, key, encrypted, metadata)
+}
+
+func (e *encryptedStore) PutBytes(key string, data []byte) error {
+	return e.Put(context.Background(), key, bytes.NewReader(data))
+}
+
+func (e *encryptedStore) Get(key string) ([]byte, error) {
+	data, metadata, err := e.getWithMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+	if metadata[metadataKey] == "" || metadata[metadataIV] == "" {
+		return nil, fmt.Errorf("object '%s' isn't client encrypted", key)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[metadataKey])
+	if err != nil {
+		return nil, errCorrupt
+	}
+	iv, err := base64.StdEncoding.DecodeString(metadata[metadataIV])
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, errCorrupt
+	}
+	dataKey, err := unwrapKey(e.key, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errCorrupt
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	return unpad(plain)
+}
+
+// encryptingReader encrypts a reader's contents as they're read, padding the end
+type encryptingReader struct {
+	r    io.Reader
+	mode cipher.BlockMode
+	// buf holds the chunk being encrypted, with room for the padding
+	buf []byte
+	// out is what's left of the encrypted chunk
+	out  []byte
+	done bool
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.r, e.buf[:chunkSize])
+		chunk := e.buf[:n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			e.done = true
+			chunk = pad(chunk)
+		} else if err != nil {
+			return 0, err
+		}
+		e.mode.CryptBlocks(chunk, chunk)
+		e.out = chunk
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// pad adds PKCS#7 padding, which always adds at least one byte
+func pad(data []byte) []byte {
+	n := aes.BlockSize - len(data)%aes.BlockSize
+	return append(data, bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+func unpad(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errCorrupt
+	}
+	n := int(data[len(data)-1])
+	if n == 0 || n > aes.BlockSize || n > len(data) {
+		return nil, errCorrupt
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, errCorrupt
+		}
+	}
+	return data[:len(data)-n], nil
+}
+
+// wrapKey encrypts a data key with the master key the way the s3 encryption client does
+// for symmetric keys, with AES-ECB and PKCS#7 padding
+func wrapKey(masterKey, dataKey []byte) ([]byte, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := pad(append([]byte{}, dataKey...))
+	for i := 0; i < len(wrapped); i += aes.BlockSize {
+		block.Encrypt(wrapped[i:i+aes.BlockSize], wrapped[i:i+aes.BlockSize])
+	}
+	return wrapped, nil
+}
+
+func unwrapKey(masterKey, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	// a 32 byte key padded to 48, so a wrong master key is caught by the full block of padding
+	if len(wrapped) != 32+aes.BlockSize {
+		return nil, errCorrupt
+	}
+	dataKey := make([]byte, len(wrapped))
+	for i := 0; i < len(wrapped); i += aes.BlockSize {
+		block.Decrypt(dataKey[i:i+aes.BlockSize], wrapped[i:i+aes.BlockSize])
+	}
+	if !bytes.Equal(dataKey[32:], bytes.Repeat([]byte{aes.BlockSize}, aes.BlockSize)) {
+		return nil, errCorrupt
+	}
+	return dataKey[:32], nil
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localStore writes objects as files under a root directory, mostly for testing. An
+// object's metadata is kept in a hidden file next to it.
+type localStore struct {
+	root string
+}
+
+func newLocalStore(root string) *localStore {
+	return &localStore{root: root}
+}
+
+func (l *localStore) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file that's renamed into place once it's complete, so a
+// failed write never leaves a partial object behind
+func (l *localStore) Put(ctx context.Context, key string, body io.Reader) error {
+	return l.putWithMetadata(ctx, key, body, nil)
+}
+
+// metadataPath is where an object's metadata is kept
+func (l *localStore) metadataPath(key string) string {
+	path := l.path(key)
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+metadataSuffix)
+}
+
+const metadataSuffix = ".metadata.json"
+
+func (l *localStore) putWithMetadata(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	path := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, contextReader{ctx: ctx, r: body}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if len(metadata) == 0 {
+		if err := os.Remove(l.metadataPath(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(l.metadataPath(key), data, 0644); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (l *localStore) PutBytes(key string, data []byte) error {
+	return l.Put(context.Background(), key, bytes.NewReader(data))
+}
+
+func (l *localStore) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (l *localStore) Size(key string) (int64, error) {
+	info, err := os.Stat(l.path(key))
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (l *localStore) getWithMetadata(key string) ([]byte, map[string]string, error) {
+	data, err := l.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata, err := l.metadata(key)
+	return data, metadata, err
+}
+
+func (l *localStore) metadata(key string) (map[string]string, error) {
+	metadata := map[string]string{}
+	data, err := ioutil.ReadFile(l.metadataPath(key))
+	if os.IsNotExist(err) {
+		return metadata, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return metadata, json.Unmarshal(data, &metadata)
+}
+
+func (l *localStore) Copy(ctx context.Context, srcKey, dstKey string) error {
+	src, err := os.Open(l.path(srcKey))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+	metadata, err := l.metadata(srcKey)
+	if err != nil {
+		return err
+	}
+	return l.putWithMetadata(ctx, dstKey, src, metadata)
+}
+
+func (l *localStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.Walk(l.root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		// skip in progress writes and metadata
+		base := filepath.Base(path)
+		if strings.HasPrefix(base, ".") && (strings.Contains(base, ".tmp") || strings.HasSuffix(base, metadataSuffix)) {
+			return nil
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (l *localStore) Delete(key string) error {
+	for _, path := range []string{l.path(key), l.metadataPath(key)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *localStore) URL(key string) string {
+	return "file://" + filepath.ToSlash(l.path(key))
+}
@@ -0,0 +1,348 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Options configures how to reach an s3 compatible service other than AWS, e.g. MinIO
+type s3Options struct {
+	// Endpoint is the service's URL, e.g. http://localhost:9000. Empty means AWS.
+	Endpoint string
+	// Region skips the bucket region lookup, which most s3 compatible services don't support
+	Region string
+	// PathStyle addresses buckets as endpoint/bucket rather than bucket.endpoint
+	PathStyle bool
+	// AccessKeyID and SecretAccessKey are static credentials, used instead of the
+	// default AWS credential chain when set
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// s3Store writes objects to a bucket, optionally under a prefix
+type s3Store struct {
+	bucket string
+	prefix string
+	opts   s3Options
+	sse    Encryption
+
+	// the client is created on first use since it needs to look up the bucket's region
+	clientOnce sync.Once
+	client     *s3.S3
+	clientErr  error
+}
+
+func newS3Store(bucket, prefix string, opts s3Options) *s3Store {
+	return &s3Store{bucket: bucket, prefix: prefix, opts: opts}
+}
+
+// getClient handles the awkwardness around s3 regions
+func (s *s3Store) getClient() (*s3.S3, error) {
+	s.clientOnce.Do(func() {
+		config := aws.NewConfig()
+		if s.opts.Endpoint != "" {
+			config = config.WithEndpoint(s.opts.Endpoint)
+		}
+		if s.opts.PathStyle {
+			config = config.WithS3ForcePathStyle(true)
+		}
+		if s.opts.AccessKeyID != "" {
+			config = config.WithCredentials(credentials.NewStaticCredentials(s.opts.AccessKeyID, s.opts.SecretAccessKey, ""))
+		}
+
+		region := s.opts.Region
+		if region == "" && s.opts.Endpoint != "" {
+			// s3 compatible services generally ignore the region, but the sdk needs one to sign requests
+			region = "us-east-1"
+		}
+		if region == "" {
+			var err error
+			if region, err = getRegionForBucket(s.bucket); err != nil {
+				s.clientErr = err
+				return
+			}
+		}
+		s.client = s3.New(session.New(), config.WithRegion(region))
+	})
+	return s.client, s.clientErr
+}
+
+// Put aborts the multipart upload if it fails or the context is cancelled, so no
+// dangling parts are left behind
+func (s *s3Store) Put(ctx context.Context, key string, body io.Reader) error {
+	return s.putWithMetadata(ctx, key, body, nil)
+}
+
+func (s *s3Store) putWithMetadata(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	// the uploader does multipart uploads, so we can stream from a pipe without
+	// knowing the size up front
+	uploader := s3manager.NewUploaderWithClient(client)
+	input := &s3manager.UploadInput{
+		Body:   body,
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, key)),
+	}
+	if len(metadata) > 0 {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	if err := s.applySSE(input); err != nil {
+		return err
+	}
+	_, err = uploader.UploadWithContext(ctx, input)
+	return err
+}
+
+// applySSE sets the server side encryption headers for an upload
+func (s *s3Store) applySSE(input *s3manager.UploadInput) error {
+	switch s.sse.SSE {
+	case "":
+		// s3 compatible services often can't do sse, so only AWS gets it by default
+		if s.opts.Endpoint == "" {
+			input.ServerSideEncryption = aws.String(SSEAES256)
+		}
+	case SSENone:
+	case SSEKMS:
+		input.ServerSideEncryption = aws.String(SSEKMS)
+		if s.sse.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(s.sse.KMSKeyID)
+		}
+		if len(s.sse.KMSContext) > 0 {
+			context, err := json.Marshal(s.sse.KMSContext)
+			if err != nil {
+				return err
+			}
+			input.SSEKMSEncryptionContext = aws.String(base64.StdEncoding.EncodeToString(context))
+		}
+	default:
+		input.ServerSideEncryption = aws.String(SSEAES256)
+	}
+	return nil
+}
+
+func (s *s3Store) PutBytes(key string, data []byte) error {
+	return s.Put(context.Background(), key, bytes.NewReader(data))
+}
+
+func (s *s3Store) Get(key string) ([]byte, error) {
+	data, _, err := s.getWithMetadata(key)
+	return data, err
+}
+
+func (s *s3Store) getWithMetadata(key string) ([]byte, map[string]string, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, key)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the sdk canonicalizes the metadata's keys like headers, e.g. X-Amz-Key
+	metadata := map[string]string{}
+	for k, v := range resp.Metadata {
+		metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return data, metadata, nil
+}
+
+func (s *s3Store) Size(key string) (int64, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return 0, err
+	}
+	head, err := client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, key)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	return aws.Int64Value(head.ContentLength), nil
+}
+
+// maxCopySize is the largest object CopyObject can copy, bigger ones need a multipart copy
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// copyPartSize is the size of each part of a multipart copy
+const copyPartSize = 512 * 1024 * 1024
+
+func (s *s3Store) Copy(ctx context.Context, srcKey, dstKey string) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	// the copy source has to be URL encoded, and our keys have colons in the timestamps
+	source := (&url.URL{Path: s.bucket + "/" + joinKey(s.prefix, srcKey)}).EscapedPath()
+	head, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, srcKey)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	// the copy gets the same encryption settings as an upload. CopyObject keeps the
+	// source's metadata, which holds the data key of client encrypted objects.
+	var upload s3manager.UploadInput
+	if err := s.applySSE(&upload); err != nil {
+		return err
+	}
+	size := aws.Int64Value(head.ContentLength)
+	if size <= maxCopySize {
+		_, err = client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:                  aws.String(s.bucket),
+			Key:                     aws.String(joinKey(s.prefix, dstKey)),
+			CopySource:              aws.String(source),
+			ServerSideEncryption:    upload.ServerSideEncryption,
+			SSEKMSKeyId:             upload.SSEKMSKeyId,
+			SSEKMSEncryptionContext: upload.SSEKMSEncryptionContext,
+		})
+		return err
+	}
+	upload.Metadata = head.Metadata
+	return s.multipartCopy(ctx, client, source, dstKey, size, upload)
+}
+
+func (s *s3Store) multipartCopy(ctx context.Context, client *s3.S3, source, dstKey string, size int64, upload s3manager.UploadInput) error {
+	created, err := client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:                  aws.String(s.bucket),
+		Key:                     aws.String(joinKey(s.prefix, dstKey)),
+		Metadata:                upload.Metadata,
+		ServerSideEncryption:    upload.ServerSideEncryption,
+		SSEKMSKeyId:             upload.SSEKMSKeyId,
+		SSEKMSEncryptionContext: upload.SSEKMSEncryptionContext,
+	})
+	if err != nil {
+		return err
+	}
+
+	parts := []*s3.CompletedPart{}
+	for start, number := int64(0), int64(1); start < size; start, number = start+copyPartSize, number+1 {
+		end := start + copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		part, err := client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(joinKey(s.prefix, dstKey)),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber:      aws.Int64(number),
+			UploadId:        created.UploadId,
+		})
+		if err != nil {
+			// not using ctx here since it may be what was cancelled
+			client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      aws.String(joinKey(s.prefix, dstKey)),
+				UploadId: created.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(number)})
+	}
+
+	_, err = client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(joinKey(s.prefix, dstKey)),
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+func (s *s3Store) List(prefix string) ([]string, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	fullPrefix := joinKey(s.prefix, prefix)
+	err = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(fullPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			if s.prefix != "" {
+				key = strings.TrimPrefix(key, s.prefix+"/")
+			}
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+func (s *s3Store) Delete(key string) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, key)),
+	})
+	return err
+}
+
+func (s *s3Store) URL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, joinKey(s.prefix, key))
+}
+
+// getRegionForBucket looks up the region name for the given bucket
+func getRegionForBucket(name string) (string, error) {
+	// Any region will work for the region lookup, but the request MUST use
+	// PathStyle
+	config := aws.NewConfig().WithRegion("us-west-1").WithS3ForcePathStyle(true)
+	session := session.New()
+	client := s3.New(session, config)
+	params := s3.GetBucketLocationInput{
+		Bucket: aws.String(name),
+	}
+	resp, err := client.GetBucketLocation(&params)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get location for bucket '%s', %s", name, err)
+	}
+	if resp.LocationConstraint == nil {
+		// "US Standard", returns an empty region. So return any region in the US
+		return "us-east-1", nil
+	}
+	return *resp.LocationConstraint, nil
+}
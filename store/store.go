@@ -0,0 +1,135 @@
+// Package store abstracts where exported data, manifests and configs get written,
+// so the same export can target s3 or a local directory.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned by Get for objects that don't exist
+var ErrNotFound = errors.New("object not found")
+
+// ObjectStore is somewhere objects can be written to and read back from by key.
+// Keys are slash separated paths relative to the root of the store. The operations
+// that can take a long time accept a context so they can be cancelled.
+type ObjectStore interface {
+	// Put streams an object of unknown size from a reader
+	Put(ctx context.Context, key string, body io.Reader) error
+	// PutBytes writes a small object
+	PutBytes(key string, data []byte) error
+	// Get reads a small object. It returns ErrNotFound if the object doesn't exist.
+	Get(key string) ([]byte, error)
+	// Size returns how many bytes are stored for an object, which can be more than were
+	// put if it was encrypted. It returns ErrNotFound if the object doesn't exist.
+	Size(key string) (int64, error)
+	// Copy copies an object to another key in the same store, overwriting anything there
+	Copy(ctx context.Context, srcKey, dstKey string) error
+	// List returns the keys of every object whose key starts with the prefix
+	List(prefix string) ([]string, error)
+	// Delete removes an object. Deleting an object that doesn't exist isn't an error.
+	Delete(key string) error
+	// URL returns the full URL of an object, e.g. s3://bucket/key
+	URL(key string) string
+}
+
+// New returns the store for a destination URL, either s3://bucket[/prefix] or file:///path.
+//
+// s3 compatible services like MinIO are configured with query parameters, e.g.
+// s3://bucket?endpoint=http://localhost:9000&path_style=true. `region` skips the bucket
+// region lookup. Static credentials are read from S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY
+// if set, otherwise the usual AWS credential chain is used.
+func New(rawurl string) (ObjectStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination '%s': %s", rawurl, err)
+	}
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("destination '%s' is missing a bucket", rawurl)
+		}
+		opts, err := parseS3Options(u.Query())
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination '%s': %s", rawurl, err)
+		}
+		return newS3Store(u.Host, strings.Trim(u.Path, "/"), opts), nil
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("destination '%s' is missing a path", rawurl)
+		}
+		return newLocalStore(u.Path), nil
+	}
+	return nil, fmt.Errorf("unsupported destination '%s', must be s3:// or file://", rawurl)
+}
+
+func parseS3Options(query url.Values) (s3Options, error) {
+	opts := s3Options{
+		Endpoint:        query.Get("endpoint"),
+		Region:          query.Get("region"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+	}
+	if pathStyle := query.Get("path_style"); pathStyle != "" {
+		var err error
+		if opts.PathStyle, err = strconv.ParseBool(pathStyle); err != nil {
+			return opts, fmt.Errorf("path_style must be true or false")
+		}
+	}
+	if opts.Endpoint != "" {
+		if u, err := url.Parse(opts.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return opts, fmt.Errorf("endpoint must be a URL like http://host:port")
+		}
+	}
+	if (opts.AccessKeyID == "") != (opts.SecretAccessKey == "") {
+		return opts, fmt.Errorf("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set together")
+	}
+	return opts, nil
+}
+
+// contextReader fails reads once its context is done, so a copy from it stops promptly
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ReadURL reads a single object given its full URL, e.g. s3://bucket/path/to/key or
+// file:///path/to/file. s3 URLs take the same query parameters as New.
+func ReadURL(rawurl string) ([]byte, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url '%s': %s", rawurl, err)
+	}
+	dir, key := path.Split(u.Path)
+	if key == "" {
+		return nil, fmt.Errorf("url '%s' is missing a key", rawurl)
+	}
+	u.Path = dir
+	s, err := New(u.String())
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(key)
+}
+
+// joinKey adds a key to a prefix, if there is one
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
@@ -0,0 +1,308 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	s, err := New("s3://bucket")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://bucket/foo/bar.json", s.URL("foo/bar.json"))
+
+	s, err = New("s3://bucket/some/prefix/")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://bucket/some/prefix/foo", s.URL("foo"))
+
+	s, err = New("file:///tmp/out")
+	assert.NoError(t, err)
+	assert.Equal(t, "file:///tmp/out/foo/bar.json", s.URL("foo/bar.json"))
+
+	s, err = New("s3://bucket/prefix?endpoint=http://localhost:9000&path_style=true&region=local")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://bucket/prefix/foo", s.URL("foo"))
+	assert.Equal(t, s3Options{Endpoint: "http://localhost:9000", Region: "local", PathStyle: true}, s.(*s3Store).opts)
+
+	for _, invalid := range []string{"bucket", "s3://", "file://", "gs://bucket",
+		"s3://bucket?path_style=maybe", "s3://bucket?endpoint=localhost"} {
+		_, err := New(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseS3OptionsCredentials(t *testing.T) {
+	defer os.Unsetenv("S3_ACCESS_KEY_ID")
+	defer os.Unsetenv("S3_SECRET_ACCESS_KEY")
+
+	os.Setenv("S3_ACCESS_KEY_ID", "id")
+	_, err := parseS3Options(url.Values{})
+	assert.Error(t, err)
+
+	os.Setenv("S3_SECRET_ACCESS_KEY", "secret")
+	opts, err := parseS3Options(url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, "id", opts.AccessKeyID)
+	assert.Equal(t, "secret", opts.SecretAccessKey)
+}
+
+// TestS3StoreMinio runs against a real s3 compatible service, e.g.
+// MINIO_ENDPOINT=http://localhost:9000 S3_ACCESS_KEY_ID=minioadmin S3_SECRET_ACCESS_KEY=minioadmin
+func TestS3StoreMinio(t *testing.T) {
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIO_ENDPOINT not set")
+	}
+
+	s, err := New("s3://mongo-to-s3-test/prefix?path_style=true&endpoint=" + url.QueryEscape(endpoint))
+	assert.NoError(t, err)
+	client, err := s.(*s3Store).getClient()
+	assert.NoError(t, err)
+	_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("mongo-to-s3-test")})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
+		assert.NoError(t, err)
+	}
+	// MinIO rejects sse without a KMS
+	s, err = WithEncryption(s, Encryption{SSE: SSENone})
+	assert.NoError(t, err)
+
+	_, err = s.Get("a/missing.json")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, s.Put(context.Background(), "a/data.json.gz", bytes.NewReader([]byte("data"))))
+	data, err := s.Get("a/data.json.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	keys, err := s.List("a/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/data.json.gz"}, keys)
+
+	assert.NoError(t, s.Copy(context.Background(), "a/data.json.gz", "b/2020-01-01T00:00:00Z.json.gz"))
+	data, err = s.Get("b/2020-01-01T00:00:00Z.json.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	size, err := s.Size("b/2020-01-01T00:00:00Z.json.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), size)
+	assert.Equal(t, ErrNotFound, s.Copy(context.Background(), "a/missing.json", "b/missing.json"))
+
+	assert.NoError(t, s.Delete("a/data.json.gz"))
+	assert.NoError(t, s.Delete("b/2020-01-01T00:00:00Z.json.gz"))
+	keys, err = s.List("a/")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestLocalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New("file://" + dir)
+	assert.NoError(t, err)
+
+	keys, err := s.List("")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = s.Get("a/missing.json")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, s.Put(context.Background(), "a/b/data.json.gz", bytes.NewReader([]byte("data"))))
+	assert.NoError(t, s.PutBytes("a/manifest", []byte("manifest")))
+	assert.NoError(t, s.PutBytes("c/other", []byte("other")))
+
+	data, err := s.Get("a/b/data.json.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	size, err := s.Size("a/b/data.json.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), size)
+	_, err = s.Size("a/missing.json")
+	assert.Equal(t, ErrNotFound, err)
+	data, err = ioutil.ReadFile(filepath.Join(dir, "a", "manifest"))
+	assert.NoError(t, err)
+	assert.Equal(t, "manifest", string(data))
+
+	keys, err = s.List("a/")
+	assert.NoError(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, []string{"a/b/data.json.gz", "a/manifest"}, keys)
+
+	assert.NoError(t, s.Copy(context.Background(), "a/manifest", "d/manifest"))
+	data, err = s.Get("d/manifest")
+	assert.NoError(t, err)
+	assert.Equal(t, "manifest", string(data))
+	assert.Equal(t, ErrNotFound, s.Copy(context.Background(), "a/missing.json", "d/missing.json"))
+
+	// a cancelled write leaves nothing behind
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.Put(ctx, "e/cancelled", bytes.NewReader([]byte("data"))))
+	_, err = s.Get("e/cancelled")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, s.Delete("a/manifest"))
+	assert.NoError(t, s.Delete("a/manifest"))
+	keys, err = s.List("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/b/data.json.gz"}, keys)
+}
+
+func TestReadURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sis.yml"), []byte("config"), 0600))
+
+	data, err := ReadURL("file://" + filepath.Join(dir, "sis.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "config", string(data))
+
+	_, err = ReadURL("file://" + filepath.Join(dir, "missing.yml"))
+	assert.Equal(t, ErrNotFound, err)
+	for _, invalid := range []string{"file://" + dir + "/", "s3://bucket", "gs://bucket/key"} {
+		_, err := ReadURL(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestWithEncryption(t *testing.T) {
+	s, err := New("s3://bucket")
+	assert.NoError(t, err)
+
+	enc := Encryption{SSE: SSEKMS, KMSKeyID: "alias/key", KMSContext: map[string]string{"table": "students"}}
+	encrypted, err := WithEncryption(s, enc)
+	assert.NoError(t, err)
+	assert.Equal(t, enc, encrypted.(*s3Store).sse)
+	assert.Equal(t, "s3://bucket/foo", encrypted.URL("foo"))
+
+	_, err = WithEncryption(s, Encryption{SSE: "rot13"})
+	assert.Error(t, err)
+	_, err = WithEncryption(s, Encryption{SSE: SSEAES256, KMSKeyID: "alias/key"})
+	assert.Error(t, err)
+	_, err = WithEncryption(s, Encryption{ClientKey: []byte("short")})
+	assert.Error(t, err)
+}
+
+func TestApplySSE(t *testing.T) {
+	onAWS, err := New("s3://bucket")
+	assert.NoError(t, err)
+	onMinio, err := New("s3://bucket?endpoint=http://localhost:9000")
+	assert.NoError(t, err)
+
+	for _, test := range []struct {
+		store ObjectStore
+		sse   string
+		want  *string
+	}{
+		{onAWS, "", aws.String(SSEAES256)},
+		{onAWS, SSEAES256, aws.String(SSEAES256)},
+		{onAWS, SSENone, nil},
+		{onMinio, "", nil},
+		{onMinio, SSEAES256, aws.String(SSEAES256)},
+		{onMinio, SSEKMS, aws.String(SSEKMS)},
+	} {
+		encrypted, err := WithEncryption(test.store, Encryption{SSE: test.sse})
+		assert.NoError(t, err)
+		input := &s3manager.UploadInput{}
+		assert.NoError(t, encrypted.(*s3Store).applySSE(input))
+		assert.Equal(t, test.want, input.ServerSideEncryption, "%s %s", test.store.URL(""), test.sse)
+	}
+}
+
+func TestClientEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	plain, err := New("file://" + dir)
+	assert.NoError(t, err)
+	key := bytes.Repeat([]byte{1}, 32)
+	s, err := WithEncryption(plain, Encryption{ClientKey: key})
+	assert.NoError(t, err)
+
+	for _, size := range []int{0, 10, 16, chunkSize, 3*chunkSize + 7} {
+		data := bytes.Repeat([]byte("x"), size)
+		assert.NoError(t, s.Put(context.Background(), "data", bytes.NewReader(data)))
+
+		// the body is padded to the next whole block, and the data key and IV are metadata
+		raw, metadata, err := plain.(*localStore).getWithMetadata("data")
+		assert.NoError(t, err)
+		assert.Equal(t, size+16-size%16, len(raw))
+		assert.False(t, bytes.Contains(raw, []byte("xxxxxxxxxx")))
+		assert.Equal(t, "{}", metadata["x-amz-matdesc"])
+		wrapped, err := base64.StdEncoding.DecodeString(metadata["x-amz-key"])
+		assert.NoError(t, err)
+		assert.Equal(t, 48, len(wrapped))
+
+		assert.NoError(t, s.Copy(context.Background(), "data", "copy"))
+		for _, key := range []string{"data", "copy"} {
+			got, err := s.Get(key)
+			assert.NoError(t, err)
+			assert.Equal(t, len(data), len(got))
+			assert.True(t, bytes.Equal(data, got))
+		}
+	}
+	keys, err := s.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"copy", "data"}, keys)
+
+	// a different key or a truncated object fails rather than returning garbage
+	other, err := WithEncryption(plain, Encryption{ClientKey: bytes.Repeat([]byte{2}, 32)})
+	assert.NoError(t, err)
+	_, err = other.Get("data")
+	assert.Equal(t, errCorrupt, err)
+
+	raw, metadata, err := plain.(*localStore).getWithMetadata("data")
+	assert.NoError(t, err)
+	assert.NoError(t, plain.(*localStore).putWithMetadata(context.Background(), "data", bytes.NewReader(raw[:len(raw)-1]), metadata))
+	_, err = s.Get("data")
+	assert.Equal(t, errCorrupt, err)
+
+	// objects written without client encryption, or deleted, lose their metadata
+	assert.NoError(t, plain.PutBytes("copy", []byte("plain")))
+	_, err = s.Get("copy")
+	assert.Error(t, err)
+	assert.NoError(t, s.Delete("data"))
+	keys, err = plain.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"copy"}, keys)
+	_, err = os.Stat(filepath.Join(dir, ".copy.metadata.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{7}, 32)
+	rawPath := filepath.Join(dir, "raw")
+	encodedPath := filepath.Join(dir, "encoded")
+	shortPath := filepath.Join(dir, "short")
+	assert.NoError(t, ioutil.WriteFile(rawPath, key, 0600))
+	assert.NoError(t, ioutil.WriteFile(encodedPath, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(shortPath, []byte("c2hvcnQ="), 0600))
+
+	for _, path := range []string{rawPath, encodedPath} {
+		got, err := ReadKeyFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, key, got)
+	}
+	_, err = ReadKeyFile(shortPath)
+	assert.Error(t, err)
+}
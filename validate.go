@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Clever/mongo-to-s3/config"
+)
+
+// validateCommand checks config files and prints every problem found, for use in the
+// config repo's pre-merge checks. It returns the exit code.
+//
+//	mongo-to-s3 validate <file>...
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mongo-to-s3 validate <file>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	problems := 0
+	for _, path := range fs.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Printf("%s: %s\n", path, err)
+			problems++
+			continue
+		}
+		conf, err := config.ParseYAML(data)
+		if err != nil {
+			fmt.Printf("%s: %s\n", path, err)
+			problems++
+			continue
+		}
+		for _, verr := range conf.Validate() {
+			fmt.Printf("%s: %s\n", path, verr)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		fmt.Printf("%d problem(s) found\n", problems)
+		return 1
+	}
+	return 0
+}